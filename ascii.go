@@ -0,0 +1,60 @@
+package ftpserver
+
+import "io"
+
+/* TYPE A on the way out: a bare LF becomes CRLF, existing CRLF stays */
+type crlfWriter struct {
+	writer io.Writer
+	cr     bool
+}
+
+func (w *crlfWriter) Write(msg []byte) (int, error) {
+	var buf = make([]byte, 0, len(msg)+len(msg)/16+1)
+	for _, b := range msg {
+		if b == '\n' && !w.cr {
+			buf = append(buf, '\r')
+		}
+		buf = append(buf, b)
+		w.cr = b == '\r'
+	}
+
+	if _, err := w.writer.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+// lfWriter converts TYPE A on the way in: CRLF becomes LF. A CR is held
+// back until the next byte shows whether it starts a line ending.
+type lfWriter struct {
+	writer io.Writer
+	cr     bool
+}
+
+func (w *lfWriter) Write(msg []byte) (int, error) {
+	var buf = make([]byte, 0, len(msg)+1)
+	for _, b := range msg {
+		if w.cr && b != '\n' {
+			buf = append(buf, '\r')
+		}
+		w.cr = b == '\r'
+		if !w.cr {
+			buf = append(buf, b)
+		}
+	}
+
+	if _, err := w.writer.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(msg), nil
+}
+
+/* write out a CR still held back at the end of the stream */
+func (w *lfWriter) Flush() error {
+	if !w.cr {
+		return nil
+	}
+	w.cr = false
+	_, err := w.writer.Write([]byte{'\r'})
+	return err
+}
@@ -0,0 +1,110 @@
+package ftpserver
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"time"
+)
+
+// ErrAuthFailed is what an Authenticator returns for a wrong user name or
+// password. Other errors are logged as a failing backend, both refuse the
+// login with 530.
+var ErrAuthFailed = errors.New("Error: Authentication failed.")
+
+// AuthInfo is what the client presented at PASS.
+type AuthInfo struct {
+	Name   string
+	Pass   string
+	Remote net.Addr
+	/* nil on a plain text control connection */
+	TLS *tls.ConnectionState
+	/* the RFC 7151 HOST of the session, "" without one */
+	Host string
+}
+
+// Identity is the user an Authenticator logged in. Perms has the bit
+// 1<<GET, 1<<PUT, ... set for each permission, see PermMask.
+type Identity struct {
+	Name  string
+	Root  string
+	Perms uint
+
+	/* per-user settings, nil and 0 keep the ones of the session */
+	Umask *os.FileMode
+	Idle  time.Duration
+}
+
+// Authenticator checks a login. The user list of the config file is the
+// default one, NewServer takes another.
+type Authenticator interface {
+	Authenticate(info *AuthInfo) (*Identity, error)
+}
+
+// PermMask returns the Perms of an Identity with the permissions perms.
+func PermMask(perms ...uint) uint {
+	var mask uint
+	for _, perm := range perms {
+		mask |= uint(1) << perm
+	}
+	return mask
+}
+
+// ConfAuthenticator logs in the users of the config file, the ones of the
+// virtual host after HOST.
+type ConfAuthenticator struct{}
+
+func (ConfAuthenticator) Authenticate(info *AuthInfo) (*Identity, error) {
+	var users = Conf.Users
+	if info.Host != "" {
+		var host = findHost(info.Host)
+		if host == nil {
+			return nil, ErrAuthFailed
+		}
+		users = host.Users
+	}
+
+	for _, value := range users {
+		if value.Name != info.Name {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(value.Pass), []byte(info.Pass)) != 1 {
+			return nil, ErrAuthFailed
+		}
+		return confIdentity(&value), nil
+	}
+	return nil, ErrAuthFailed
+}
+
+func confIdentity(value *userConf) *Identity {
+	var id = &Identity{
+		Name: value.Name,
+		Root: value.Root,
+		Idle: time.Duration(value.Idle_timeout) * time.Second,
+	}
+	if value.Umask != "" {
+		var umask = value.Umask_mode
+		id.Umask = &umask
+	}
+
+	var setFlag = func(permit bool, flag uint) {
+		if permit {
+			id.Perms |= PermMask(flag)
+		}
+	}
+	setFlag(value.Get, GET)
+	setFlag(value.Put, PUT)
+	setFlag(value.Delete, DELETE)
+	setFlag(value.Recover, RECOVER)
+	setFlag(value.MkDir, MKDIR)
+	setFlag(value.DelDir, DELDIR)
+	setFlag(value.Append, APPEND)
+	setFlag(value.Rename, RENAME)
+	setFlag(value.SetTime, SETTIME)
+	setFlag(value.Chmod, CHMOD)
+	setFlag(value.DelTree, DELTREE)
+	setFlag(value.SetIdle, SETIDLE)
+	return id
+}
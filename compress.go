@@ -0,0 +1,54 @@
+package ftpserver
+
+import (
+	"compress/zlib"
+	"io"
+	"net"
+)
+
+// zlibConn is a MODE Z data connection. Writes are deflated, reads
+// inflated, and Close ends the zlib stream of a download before closing
+// the connection.
+type zlibConn struct {
+	net.Conn
+	writer *zlib.Writer
+	/* zlib.NewReader reads the header, it is created on the first Read */
+	reader io.ReadCloser
+}
+
+func newZlibConn(conn net.Conn, level int) net.Conn {
+	var writer, err = zlib.NewWriterLevel(conn, level)
+	if err != nil {
+		Warnln(err)
+		writer = zlib.NewWriter(conn)
+	}
+	return &zlibConn{Conn: conn, writer: writer}
+}
+
+func (conn *zlibConn) Write(msg []byte) (int, error) {
+	return conn.writer.Write(msg)
+}
+
+func (conn *zlibConn) Read(msg []byte) (int, error) {
+	if conn.reader == nil {
+		reader, err := zlib.NewReader(conn.Conn)
+		if err != nil {
+			return 0, err
+		}
+		conn.reader = reader
+	}
+	return conn.reader.Read(msg)
+}
+
+func (conn *zlibConn) Close() error {
+	var err error
+	if conn.reader == nil {
+		err = conn.writer.Close()
+	} else {
+		conn.reader.Close()
+	}
+	if closeErr := conn.Conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
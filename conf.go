@@ -1,10 +1,14 @@
 package ftpserver
 
 import (
+	"compress/zlib"
+	"crypto/tls"
 	"encoding/json"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -18,15 +22,49 @@ type userConf struct {
 	Recover bool `json:"recover"`
 	DelDir  bool `json:"deldir"`
 	MkDir   bool `json:"mkdir"`
+	Append  bool `json:"append"`
+	Rename  bool `json:"rename"`
+	SetTime bool `json:"settime"`
+	Chmod   bool `json:"chmod"`
+	DelTree bool `json:"deltree"`
+	SetIdle bool `json:"setidle"`
+
+	/* per-user settings, the empty ones keep the host's or server's */
+	Umask        string      `json:"umask"`
+	Umask_mode   os.FileMode `json:"-"`
+	Idle_timeout int         `json:"idle_timeout"`
+}
+
+/* an RFC 7151 virtual host, the empty fields take the server's defaults */
+type hostConf struct {
+	Name         string      `json:"name"`
+	Banner       string      `json:"banner"`
+	Umask        string      `json:"umask"`
+	Umask_mode   os.FileMode `json:"-"`
+	Idle_timeout int         `json:"idle_timeout"`
+	Users        []userConf  `json:"user"`
 }
 
 type ftpserverConf struct {
-	Ftp_addr      string `json:"ftp_addr"`
-	Ftp_port      string `json:"ftp_port"`
-	Ftp_network   string
-	Ftp_d_port    string     `json:"ftp_data_port"`
-	Ftp_d_timeout int        `json:"ftp_data_timeout"`
-	Users         []userConf `json:"user"`
+	Ftp_addr             string      `json:"ftp_addr"`
+	Ftp_port             string      `json:"ftp_port"`
+	Ftp_implicit_port    string      `json:"ftp_implicit_port"`
+	Ftp_network          string      `json:"ftp_network"`
+	Ftp_d_port           string      `json:"ftp_data_port"`
+	Ftp_d_timeout        int         `json:"ftp_data_timeout"`
+	Ftp_tls_cert         string      `json:"ftp_tls_cert"`
+	Ftp_tls_key          string      `json:"ftp_tls_key"`
+	Ftp_z_max_level      int         `json:"ftp_z_max_level"`
+	Ftp_umask            string      `json:"ftp_umask"`
+	Ftp_umask_mode       os.FileMode `json:"-"`
+	Ftp_idle_timeout     int         `json:"ftp_idle_timeout"`
+	Ftp_max_idle_timeout int         `json:"ftp_max_idle_timeout"`
+	Ftp_banner           string      `json:"ftp_banner"`
+	Ftp_max_line         int         `json:"ftp_max_line"`
+	Ftp_lang_dir         string      `json:"ftp_lang_dir"`
+	Ftp_tls              *tls.Config `json:"-"`
+	Users                []userConf  `json:"user"`
+	Hosts                []hostConf  `json:"host"`
 }
 
 var Conf = ftpserverConf{}
@@ -48,16 +86,131 @@ func Load_config(path string) {
 		log.Fatalln(err)
 	}
 
+	Conf.Ftp_network = ""
 	err = json.Unmarshal(data, &Conf)
 	if err != nil {
 		log.Fatalln(err, data, path)
 	}
 
-	if strings.Contains(Conf.Ftp_addr, ":") {
-		Conf.Ftp_network = "tcp6"
-	} else {
-		Conf.Ftp_network = "tcp4"
+	/* "tcp" listens dual-stack, otherwise follow the address family */
+	if Conf.Ftp_network != "tcp" && Conf.Ftp_network != "tcp4" &&
+		Conf.Ftp_network != "tcp6" {
+		if Conf.Ftp_addr == "" {
+			Conf.Ftp_network = "tcp"
+		} else if strings.Contains(Conf.Ftp_addr, ":") {
+			Conf.Ftp_network = "tcp6"
+		} else {
+			Conf.Ftp_network = "tcp4"
+		}
+	}
+
+	/* the highest level OPTS MODE Z LEVEL accepts, 1 to 9 */
+	if Conf.Ftp_z_max_level < zlib.BestSpeed ||
+		Conf.Ftp_z_max_level > zlib.BestCompression {
+		Conf.Ftp_z_max_level = zlib.BestCompression
+	}
+
+	/* the octal umask of new files and dictionaries, "022" if unset */
+	if Conf.Ftp_umask == "" {
+		Conf.Ftp_umask = "022"
+	}
+	umask, err := strconv.ParseUint(Conf.Ftp_umask, 8, 32)
+	if err != nil || umask > 0777 {
+		log.Fatalln("Error: bad ftp_umask", Conf.Ftp_umask)
+	}
+	Conf.Ftp_umask_mode = os.FileMode(umask)
+
+	/* the longest command line, without its CRLF */
+	if Conf.Ftp_max_line <= 0 {
+		Conf.Ftp_max_line = 4096
+	}
+
+	/* the LANG catalogs, a relative directory is next to the config file */
+	var langDir = Conf.Ftp_lang_dir
+	if langDir != "" && !filepath.IsAbs(langDir) {
+		langDir = filepath.Join(filepath.Dir(path), langDir)
+	}
+	if err := loadCatalogs(langDir); err != nil {
+		log.Fatalln("Error: bad ftp_lang_dir", err)
+	}
+
+	if Conf.Ftp_banner == "" {
+		Conf.Ftp_banner = "HKM FTP Server Ready"
+	}
+
+	/* idle timeouts are seconds, SITE IDLE may go up to the maximum */
+	if Conf.Ftp_idle_timeout < 0 {
+		Conf.Ftp_idle_timeout = 0
+	}
+	if Conf.Ftp_max_idle_timeout < Conf.Ftp_idle_timeout {
+		Conf.Ftp_max_idle_timeout = Conf.Ftp_idle_timeout
+	}
+
+	for i := range Conf.Hosts {
+		var host = &Conf.Hosts[i]
+		if host.Name == "" || findHost(host.Name) != host {
+			log.Fatalln("Error: empty or repeated host name", host.Name)
+		}
+		if host.Banner == "" {
+			host.Banner = Conf.Ftp_banner
+		}
+		if host.Idle_timeout <= 0 {
+			host.Idle_timeout = Conf.Ftp_idle_timeout
+		}
+
+		host.Umask_mode = Conf.Ftp_umask_mode
+		if host.Umask != "" {
+			umask, err := strconv.ParseUint(host.Umask, 8, 32)
+			if err != nil || umask > 0777 {
+				log.Fatalln("Error: bad umask of host", host.Name, host.Umask)
+			}
+			host.Umask_mode = os.FileMode(umask)
+		}
+		checkUsers(host.Users)
+	}
+	checkUsers(Conf.Users)
+
+	/* FTPS is only offered when both certificate and key are configured */
+	Conf.Ftp_tls = nil
+	if Conf.Ftp_tls_cert != "" && Conf.Ftp_tls_key != "" {
+		cert, err := tls.LoadX509KeyPair(Conf.Ftp_tls_cert, Conf.Ftp_tls_key)
+		if err != nil {
+			log.Fatalln(err, Conf.Ftp_tls_cert, Conf.Ftp_tls_key)
+		}
+		Conf.Ftp_tls = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS12,
+		}
+	}
+}
+
+/* parse the per-user umasks, a negative idle timeout is none */
+func checkUsers(users []userConf) {
+	for i := range users {
+		var user = &users[i]
+		if user.Umask != "" {
+			umask, err := strconv.ParseUint(user.Umask, 8, 32)
+			if err != nil || umask > 0777 {
+				log.Fatalln("Error: bad umask of user", user.Name, user.Umask)
+			}
+			user.Umask_mode = os.FileMode(umask)
+		}
+		if user.Idle_timeout < 0 {
+			user.Idle_timeout = 0
+		}
+	}
+}
+
+// findHost returns the virtual host called name, nil if there is none.
+// Names compare case-insensitively, IPv6 literals with or without brackets.
+func findHost(name string) *hostConf {
+	name = strings.Trim(name, "[]")
+	for i := range Conf.Hosts {
+		if strings.EqualFold(strings.Trim(Conf.Hosts[i].Name, "[]"), name) {
+			return &Conf.Hosts[i]
+		}
 	}
+	return nil
 }
 
 func init() {
@@ -2,26 +2,56 @@ package ftpserver
 
 import (
 	"bufio"
+	"crypto/tls"
 	"net"
+	"sync"
+	"time"
 )
 
 type CtrlDriver interface {
 	Welcome() error
+	/* the raw reply, Reply and ReplyMulti format it */
 	Response(string) error
+	ReplyRequire
 	ExitControl()
 	Reader() *bufio.Reader
+	UpgradeTLS(*tls.Config) error
+	IsSecure() bool
+	TLSState() *tls.ConnectionState
+	SetPbsz(bool)
+	HasPbsz() bool
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+
+	/* SITE IDLE, 0 waits for the next command forever */
+	SetIdle(time.Duration)
+	GetIdle() time.Duration
+	WaitIdle() error
+
+	/* RFC 2640 LANG, the language replies are translated to */
+	SetLang(string)
+	GetLang() string
 }
 
 type Controller struct {
-	ctrl *net.TCPConn
+	/* replies come from the control and the transfer goroutine */
+	mutex  sync.Mutex
+	ctrl   net.Conn
+	reader *bufio.Reader
+	secure bool
+	pbsz   bool
+	idle   time.Duration
+	lang   string
 }
 
 func (ctrl *Controller) Welcome() error {
-	_, err := ctrl.ctrl.Write([]byte("220 HKM FTP Server Ready\r\n"))
-	return err
+	return ctrl.Reply(CodeServiceReady, Conf.Ftp_banner)
 }
 
 func (ctrl *Controller) Response(msg string) error {
+	ctrl.mutex.Lock()
+	defer ctrl.mutex.Unlock()
+
 	_, err := ctrl.ctrl.Write([]byte(msg))
 	return err
 }
@@ -33,11 +63,80 @@ func (ctrl *Controller) ExitControl() {
 }
 
 func (ctrl *Controller) Reader() *bufio.Reader {
-	return bufio.NewReader(ctrl.ctrl)
+	return ctrl.reader
+}
+
+// UpgradeTLS switches the control connection to TLS. Any plaintext the
+// client pipelined behind the AUTH command is discarded.
+func (ctrl *Controller) UpgradeTLS(config *tls.Config) error {
+	var conn = tls.Server(ctrl.ctrl, config)
+
+	if err := conn.SetDeadline(time.Now().Add(20 * time.Second)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	ctrl.ctrl = conn
+	ctrl.reader.Reset(conn)
+	ctrl.secure = true
+	return nil
+}
+
+func (ctrl *Controller) IsSecure() bool {
+	return ctrl.secure
+}
+
+/* the TLS state of the control connection, nil before AUTH TLS */
+func (ctrl *Controller) TLSState() *tls.ConnectionState {
+	if conn, ok := ctrl.ctrl.(*tls.Conn); ok {
+		var state = conn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+func (ctrl *Controller) SetPbsz(pbsz bool) {
+	ctrl.pbsz = pbsz
+}
+
+func (ctrl *Controller) HasPbsz() bool {
+	return ctrl.pbsz
+}
+
+func (ctrl *Controller) LocalAddr() net.Addr {
+	return ctrl.ctrl.LocalAddr()
+}
+
+func (ctrl *Controller) RemoteAddr() net.Addr {
+	return ctrl.ctrl.RemoteAddr()
+}
+
+func (ctrl *Controller) SetIdle(idle time.Duration) {
+	ctrl.idle = idle
+}
+
+func (ctrl *Controller) GetIdle() time.Duration {
+	return ctrl.idle
+}
+
+/* arm the idle timeout before reading the next command */
+func (ctrl *Controller) WaitIdle() error {
+	if ctrl.idle == 0 {
+		return ctrl.ctrl.SetReadDeadline(time.Time{})
+	}
+	return ctrl.ctrl.SetReadDeadline(time.Now().Add(ctrl.idle))
 }
 
-func NewControler(conn *net.TCPConn) *Controller {
+func NewControler(conn net.Conn) *Controller {
 	return &Controller{
-		ctrl: conn,
+		ctrl:   conn,
+		reader: bufio.NewReader(conn),
+		idle:   time.Duration(Conf.Ftp_idle_timeout) * time.Second,
+		lang:   defaultLang,
 	}
 }
@@ -1,6 +1,9 @@
 package ftpserver
 
 import (
+	"compress/zlib"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -8,6 +11,8 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,49 +23,112 @@ var (
 	errDataWrite  = errors.New("Error:data connection write error.")
 	errDataRead   = errors.New("Error:data connection read error.")
 	errListener   = errors.New("Error:listen error.")
+	errNoDataConn = errors.New("Error:no data connection has been requested.")
 )
 
 type DataDriver interface {
 	Write(msg []byte) (int, error)
 	Read(msg []byte) (int, error)
 	WriteAll(msg []byte) error
-	WaitDataConn()
+	WaitDataConn(context.Context) error
+	HasDataConn() bool
 	DataClose()
+	DataAbort()
 	DataCreatePort(remote *net.TCPAddr)
 	DataCreatePasv(*net.TCPListener)
-	GetDataConn() *net.TCPConn
+	/* wrap the connection as the current PROT and MODE ask */
+	StartDataConn()
+	GetDataConn() net.Conn
+	GetDataMode() string
+	GetDataBytes() int64
+	SetProtection(*tls.Config)
+	IsProtected() bool
+	SetEpsvAll()
+	IsEpsvAll() bool
+
+	/* MODE Z deflates the transfers started after it */
+	SetCompression(bool)
+	IsCompressed() bool
+	SetCompressLevel(int)
+	GetCompressLevel() int
 }
 
 type DataRequire interface {
-	Response(string) error
+	ReplyRequire
+	LocalAddr() net.Addr
 }
 
 type DataConn struct {
-	wait chan int
-	conn *net.TCPConn
+	/* the control and transfer goroutines both use the connection */
+	mutex sync.Mutex
+	/* closed when the requested connection is established or failed */
+	wait   chan struct{}
+	listen *net.TCPListener
+	conn   net.Conn
+	/* not nil after "PROT P", the data connections are wrapped in TLS */
+	protect *tls.Config
+	/* after "EPSV ALL" only EPSV may set up the data connection */
+	epsvAll bool
+	/* "active" or "passive" while a data connection is requested */
+	mode string
+	/* bytes moved on the current data connection */
+	bytes int64
+	/* MODE Z and its OPTS MODE Z LEVEL, 0 until OPTS sets one */
+	compress bool
+	level    int
 }
 
 func NewDataConn() *DataConn {
-	return &DataConn{
-		wait: make(chan int, 1),
-	}
+	return &DataConn{}
 }
 
-func (data *DataConn) WaitDataConn() {
-	<-data.wait
+func (data *DataConn) getConn() net.Conn {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.conn
 }
 
-func (data *DataConn) Write(msg []byte) (int, error) {
+/* whether PORT or PASV has been sent, connected or not */
+func (data *DataConn) HasDataConn() bool {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.wait != nil || data.conn != nil
+}
 
-	if data.conn == nil {
+func (data *DataConn) WaitDataConn(ctx context.Context) error {
+	data.mutex.Lock()
+	var wait = data.wait
+	data.mutex.Unlock()
+
+	if wait != nil {
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if data.getConn() == nil {
+		if wait == nil {
+			return errNoDataConn
+		}
+		return errDataCreate
+	}
+	return nil
+}
+
+func (data *DataConn) Write(msg []byte) (int, error) {
+	var conn = data.getConn()
+	if conn == nil {
 		return 0, errDataCreate
 	}
 
-	if err := data.conn.SetWriteDeadline(time.Now().Add(20 * time.Second)); err != nil {
+	if err := conn.SetWriteDeadline(time.Now().Add(20 * time.Second)); err != nil {
 		return 0, errSetTimeout
 	}
 
-	n, err := data.conn.Write(msg)
+	n, err := conn.Write(msg)
+	atomic.AddInt64(&data.bytes, int64(n))
 	if err != nil {
 		Warnln(err)
 		return 0, errDataWrite
@@ -70,42 +138,38 @@ func (data *DataConn) Write(msg []byte) (int, error) {
 }
 
 func (data *DataConn) WriteAll(msg []byte) error {
-
-	if data.conn == nil {
+	var conn = data.getConn()
+	if conn == nil {
 		return errDataCreate
 	}
 
-	var length = len(msg)
-	var start = 0
-	if err := data.conn.SetWriteDeadline(time.Now().Add(20 * time.Second)); err != nil {
+	if err := conn.SetWriteDeadline(time.Now().Add(20 * time.Second)); err != nil {
 		return errSetTimeout
 	}
 
-	for {
-		n, err := data.conn.Write(msg[start:])
+	for start := 0; start < len(msg); {
+		n, err := conn.Write(msg[start:])
+		atomic.AddInt64(&data.bytes, int64(n))
 		if err != nil {
 			Warnln(err)
 			return errDataWrite
 		}
-
-		if n == length {
-			break
-		}
-		start = n
+		start += n
 	}
 	return nil
 }
 
 func (data *DataConn) Read(msg []byte) (int, error) {
-
-	if data.conn == nil {
+	var conn = data.getConn()
+	if conn == nil {
 		return 0, errDataCreate
 	}
 
-	if err := data.conn.SetReadDeadline(time.Now().Add(20 * time.Second)); err != nil {
+	if err := conn.SetReadDeadline(time.Now().Add(20 * time.Second)); err != nil {
 		return 0, errSetTimeout
 	}
-	num, err := data.conn.Read(msg)
+	num, err := conn.Read(msg)
+	atomic.AddInt64(&data.bytes, int64(num))
 	if err != nil {
 		if err == io.EOF {
 			return num, err
@@ -117,64 +181,279 @@ func (data *DataConn) Read(msg []byte) (int, error) {
 }
 
 func (data *DataConn) DataClose() {
-	data.conn.SetLinger(-1)
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+
+	data.wait = nil
+	data.mode = ""
+	if data.conn == nil {
+		return
+	}
+
+	if tcp, ok := data.conn.(*net.TCPConn); ok {
+		tcp.SetLinger(-1)
+	}
 	if err := data.conn.Close(); err != nil {
 		Warnln(err)
 	}
 	data.conn = nil
 }
 
-func (data *DataConn) DataCreatePort(remote *net.TCPAddr) {
+// DataAbort interrupts the data connection: a pending PASV accept fails at
+// once and blocked reads and writes return. The transfer still calls
+// DataClose when it notices.
+func (data *DataConn) DataAbort() {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
 
-	conn, err := net.DialTCP(Conf.Ftp_network, nil, remote)
-	if err != nil {
-		log.Println(err)
+	if data.listen != nil {
+		data.listen.Close()
+	}
+	/* the transfer may still be writing, don't end the zlib stream here */
+	if conn, ok := data.conn.(*zlibConn); ok {
+		conn.Conn.Close()
+	} else if data.conn != nil {
+		data.conn.Close()
+	}
+}
+
+/* start waiting for a new data connection, replacing any pending one */
+func (data *DataConn) prepare(listen *net.TCPListener) chan struct{} {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+
+	if data.listen != nil {
+		data.listen.Close()
+	}
+	data.listen = listen
+	if listen == nil {
+		data.mode = "active"
 	} else {
-		if err := conn.SetKeepAlivePeriod(time.Second * 20); err != nil {
+		data.mode = "passive"
+	}
+	atomic.StoreInt64(&data.bytes, 0)
+	data.wait = make(chan struct{})
+	return data.wait
+}
+
+/* publish the connection unless a newer PORT or PASV replaced it */
+func (data *DataConn) ready(wait chan struct{}, conn *net.TCPConn) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	defer close(wait)
+
+	if data.wait != wait {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+
+	data.listen = nil
+	if conn != nil {
+		if err := conn.SetKeepAlivePeriod(20 * time.Second); err != nil {
 			Warnln(err)
 		}
 		data.conn = conn
 	}
-	data.wait <- 1
+}
+
+// StartDataConn applies the PROT level and MODE of the transfer start to
+// the new data connection, whether they were sent before or after it was
+// opened.
+func (data *DataConn) StartDataConn() {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+
+	if tcp, ok := data.conn.(*net.TCPConn); ok {
+		data.conn = data.secureConn(tcp)
+		if data.compress {
+			data.conn = newZlibConn(data.conn, data.compressLevel())
+		}
+	}
+}
+
+func (data *DataConn) DataCreatePort(remote *net.TCPAddr) {
+	var wait = data.prepare(nil)
+
+	go func() {
+		var dialer = net.Dialer{Timeout: 20 * time.Second}
+		conn, err := dialer.Dial(ipNetwork(remote.IP), remote.String())
+		if err != nil {
+			log.Println(err)
+			data.ready(wait, nil)
+			return
+		}
+		data.ready(wait, conn.(*net.TCPConn))
+	}()
 }
 
 func (data *DataConn) DataCreatePasv(listen *net.TCPListener) {
+	var wait = data.prepare(listen)
 
-	if err := listen.SetDeadline(time.Now().Add(20 * time.Second)); err != nil {
-		Warnln(err)
-	}
-	conn, err := listen.AcceptTCP()
-	if err != nil {
-		Warnln(err)
-	} else {
-		if err := conn.SetKeepAlivePeriod(20 * time.Second); err != nil {
+	go func() {
+		defer listen.Close()
+
+		if err := listen.SetDeadline(time.Now().Add(20 * time.Second)); err != nil {
 			Warnln(err)
 		}
-		data.conn = conn
+		conn, err := listen.AcceptTCP()
+		if err != nil {
+			Warnln(err)
+		}
+		data.ready(wait, conn)
+	}()
+}
+
+func (data *DataConn) GetDataConn() net.Conn {
+	return data.getConn()
+}
+
+func (data *DataConn) GetDataMode() string {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.mode
+}
+
+func (data *DataConn) GetDataBytes() int64 {
+	return atomic.LoadInt64(&data.bytes)
+}
+
+func (data *DataConn) SetProtection(config *tls.Config) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	data.protect = config
+}
+
+func (data *DataConn) IsProtected() bool {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.protect != nil
+}
+
+func (data *DataConn) SetEpsvAll() {
+	data.epsvAll = true
+}
+
+func (data *DataConn) IsEpsvAll() bool {
+	return data.epsvAll
+}
+
+func (data *DataConn) SetCompression(compress bool) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	data.compress = compress
+}
+
+func (data *DataConn) IsCompressed() bool {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.compress
+}
+
+func (data *DataConn) SetCompressLevel(level int) {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	data.level = level
+}
+
+func (data *DataConn) GetCompressLevel() int {
+	data.mutex.Lock()
+	defer data.mutex.Unlock()
+	return data.compressLevel()
+}
+
+/* the zlib default, unless the configured maximum is lower */
+func (data *DataConn) compressLevel() int {
+	if data.level != 0 {
+		return data.level
 	}
-	data.wait <- 1
+	if Conf.Ftp_z_max_level < 6 {
+		return Conf.Ftp_z_max_level
+	}
+	return 6
 }
 
-func (data *DataConn) GetDataConn() *net.TCPConn {
-	return data.conn
+// RFC 4217: the server is always the TLS server on the data connection,
+// whether it was opened by PORT or PASV. The handshake happens on first use.
+// The caller holds data.mutex.
+func (data *DataConn) secureConn(conn *net.TCPConn) net.Conn {
+	if data.protect == nil {
+		return conn
+	}
+	return tls.Server(conn, data.protect)
+}
+
+func ipNetwork(ip net.IP) string {
+	if ip.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
+
+/* whether the configured ftp_network allows data connections over network */
+func networkAllowed(network string) bool {
+	return Conf.Ftp_network == "tcp" || Conf.Ftp_network == network
+}
+
+/* the RFC 2428 network protocol numbers this server accepts */
+func supportedProtocols() string {
+	if Conf.Ftp_network == "tcp4" {
+		return "(1)"
+	} else if Conf.Ftp_network == "tcp6" {
+		return "(2)"
+	}
+	return "(1,2)"
+}
+
+/* the IP the client reached us on, nil if the control connection isn't TCP */
+func localIP(require DataRequire) net.IP {
+	if addr, ok := require.LocalAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+/* passive data connections listen on the address the client reached us on */
+func listenPasv(ip net.IP) (*net.TCPListener, *net.TCPAddr, error) {
+	listen, err := net.ListenTCP(ipNetwork(ip), &net.TCPAddr{IP: ip})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var addr, ok = listen.Addr().(*net.TCPAddr)
+	if !ok {
+		listen.Close()
+		return nil, nil, errListener
+	}
+	return listen, addr, nil
 }
 
 func commandPort(info []byte, driver DataDriver, requeire DataRequire) error {
+	if driver.IsEpsvAll() {
+		return requeire.Reply(CodeBadSequence, "Only EPSV is allowed after EPSV ALL")
+	}
+
+	if !networkAllowed("tcp4") {
+		return requeire.Replyf(CodeProtocolNotSupported, "Network protocol not supported, use %s",
+			supportedProtocols())
+	}
+
 	var portInfo = strings.Split(string(info), ",")
 	if len(portInfo) != 6 {
-		return requeire.Response("501 Parameter syntax error.Can't idenfiy port info\r\n")
+		return requeire.Reply(CodeParameterError, "Parameter syntax error.Can't idenfiy port info")
 	}
 
 	if driver.GetDataConn() != nil {
-		return requeire.Response(
-			"550 The operation that did not execute.The data connection has been created\r\n")
+		return requeire.Reply(CodeFileUnavailable,
+			"The operation that did not execute.The data connection has been created")
 	}
 
 	var port int
 	for i, bit := range portInfo {
 		num, err := strconv.Atoi(bit)
 		if err != nil || num < 0 || num > 255 {
-			return requeire.Response("501 Parameter syntax error.Can't idenfiy port info\r\n")
+			return requeire.Reply(CodeParameterError, "Parameter syntax error.Can't idenfiy port info")
 		}
 
 		if i >= 4 {
@@ -187,40 +466,173 @@ func commandPort(info []byte, driver DataDriver, requeire DataRequire) error {
 
 	remote, err := net.ResolveTCPAddr("tcp4", remoteStr)
 	if err != nil {
-		return requeire.Response(
-			"550 The operation that did not execute.There are local unknown errors\r\n")
+		return requeire.Reply(CodeFileUnavailable,
+			"The operation that did not execute.There are local unknown errors")
 	}
 
-	go driver.DataCreatePort(remote)
+	driver.DataCreatePort(remote)
 
-	return requeire.Response("226 Creating data connection\r\n")
+	return requeire.Reply(CodeOK, "PORT command successful")
 }
 
 func commandPasv(info []byte, driver DataDriver, requeire DataRequire) error {
 	if len(info) != 0 {
-		return requeire.Response(
-			fmt.Sprintf("501 Parameter syntax error,Can't idetify %s", string(info)))
+		return requeire.Replyf(CodeParameterError,
+			"Parameter syntax error,Can't idetify %s", string(info))
 	}
 
-	listen, err := net.Listen("tcp4", Conf.Ftp_addr+":0")
-	if err != nil {
+	if driver.IsEpsvAll() {
+		return requeire.Reply(CodeBadSequence, "Only EPSV is allowed after EPSV ALL")
+	}
+
+	var local = localIP(requeire)
+	if local == nil {
+		return requeire.Reply(CodeCantOpenDataConn, "Can't open passive connection")
+	} else if local.To4() == nil {
+		return requeire.Reply(CodeCantOpenDataConn, "Can't open passive connection on IPv6, use EPSV")
+	}
+
+	listen, addr, err := listenPasv(local)
+	if err == errListener {
+		return requeire.Reply(CodeCantOpenDataConn, "Can't open passive connection")
+	} else if err != nil {
 		Warnln(err)
 		return errListener
 	}
 
-	var ip = listen.Addr().(*net.TCPAddr).IP
-	var port = listen.Addr().(*net.TCPAddr).Port
+	var ip = addr.IP.To4()
+	var port = addr.Port
 
-	var encode = fmt.Sprintf("(%d,%d,%d,%d,%d,%d) \r\n",
+	driver.DataCreatePasv(listen)
+
+	return requeire.Replyf(CodeEnteringPassive, "Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
 		ip[0], ip[1], ip[2], ip[3],
 		(port&0xFF00)>>8, (port & 0x00FF))
+}
 
-	var msg = fmt.Sprintf("227 %s%s\r\n",
-		"Entering Passive Mode", encode)
+func commandEprt(info []byte, driver DataDriver, requeire DataRequire) error {
+	if driver.IsEpsvAll() {
+		return requeire.Reply(CodeBadSequence, "Only EPSV is allowed after EPSV ALL")
+	}
+
+	/* |<net-prt>|<net-addr>|<tcp-port>| with any delimiter */
+	if len(info) < 2 {
+		return requeire.Reply(CodeParameterError, "Parameter syntax error.Can't idenfiy port info")
+	}
+	var fields = strings.Split(string(info), string(info[0]))
+	if len(fields) != 5 || fields[0] != "" || fields[4] != "" {
+		return requeire.Reply(CodeParameterError, "Parameter syntax error.Can't idenfiy port info")
+	}
+
+	var network string
+	if fields[1] == "1" {
+		network = "tcp4"
+	} else if fields[1] == "2" {
+		network = "tcp6"
+	}
+	if network == "" || !networkAllowed(network) {
+		return requeire.Replyf(CodeProtocolNotSupported, "Network protocol not supported, use %s",
+			supportedProtocols())
+	}
+
+	var ip = net.ParseIP(fields[2])
+	if ip == nil || ipNetwork(ip) != network {
+		return requeire.Reply(CodeParameterError, "Parameter syntax error.Can't idenfiy port info")
+	}
+
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port <= 0 || port > 0xFFFF {
+		return requeire.Reply(CodeParameterError, "Parameter syntax error.Can't idenfiy port info")
+	}
+
+	if driver.GetDataConn() != nil {
+		return requeire.Reply(CodeFileUnavailable,
+			"The operation that did not execute.The data connection has been created")
+	}
+
+	driver.DataCreatePort(&net.TCPAddr{IP: ip, Port: port})
 
-	go driver.DataCreatePasv(listen.(*net.TCPListener))
+	return requeire.Reply(CodeOK, "EPRT command successful")
+}
+
+func commandEpsv(info []byte, driver DataDriver, requeire DataRequire) error {
+	var local = localIP(requeire)
+
+	switch strings.ToUpper(string(info)) {
+	case "":
+	case "ALL":
+		driver.SetEpsvAll()
+		return requeire.Reply(CodeOK, "EPSV ALL ok")
+	case "1":
+		if local != nil && ipNetwork(local) != "tcp4" {
+			return requeire.Reply(CodeProtocolNotSupported, "Network protocol not supported, use (2)")
+		}
+	case "2":
+		if local != nil && ipNetwork(local) != "tcp6" {
+			return requeire.Reply(CodeProtocolNotSupported, "Network protocol not supported, use (1)")
+		}
+	default:
+		return requeire.Replyf(CodeParameterError,
+			"Parameter syntax error,Can't idetify %s", string(info))
+	}
+
+	if local == nil {
+		return requeire.Reply(CodeCantOpenDataConn, "Can't open passive connection")
+	}
+
+	listen, addr, err := listenPasv(local)
+	if err == errListener {
+		return requeire.Reply(CodeCantOpenDataConn, "Can't open passive connection")
+	} else if err != nil {
+		Warnln(err)
+		return errListener
+	}
+
+	driver.DataCreatePasv(listen)
+
+	return requeire.Replyf(CodeEnteringExtendedPassive, "Entering Extended Passive Mode (|||%d|)",
+		addr.Port)
+}
+
+/* RFC 959 MODE S is the default, deflate (MODE Z) is the only other mode */
+func commandMode(info []byte, driver DataDriver, require DataRequire) error {
+	switch strings.ToUpper(string(info)) {
+	case "S":
+		driver.SetCompression(false)
+		return require.Reply(CodeOK, "Mode set to S")
+	case "Z":
+		driver.SetCompression(true)
+		return require.Reply(CodeOK, "Mode set to Z")
+	case "B", "C":
+		return require.Replyf(CodeParameterNotImplemented, "Mode %s not implemented", string(info))
+	}
+	return require.Reply(CodeParameterError, "Parameter syntax error.Unknown mode")
+}
+
+/* "OPTS MODE Z LEVEL n", bounded by ftp_z_max_level */
+func commandOptsMode(info []byte, driver DataDriver, require DataRequire) error {
+	var args = strings.Fields(strings.ToUpper(string(info)))
+	if len(args) == 0 || args[0] != "Z" {
+		return require.Reply(CodeParameterError, "Option not understood")
+	}
+
+	if len(args) == 1 {
+		return require.Replyf(CodeOK, "MODE Z LEVEL %d",
+			driver.GetCompressLevel())
+	}
+
+	if len(args) != 3 || args[1] != "LEVEL" {
+		return require.Reply(CodeParameterError, "Option not understood")
+	}
+	var level, err = strconv.Atoi(args[2])
+	if err != nil || level < zlib.BestSpeed || level > Conf.Ftp_z_max_level {
+		return require.Replyf(CodeParameterError,
+			"Compression level must be between %d and %d",
+			zlib.BestSpeed, Conf.Ftp_z_max_level)
+	}
 
-	return requeire.Response(msg)
+	driver.SetCompressLevel(level)
+	return require.Replyf(CodeOK, "MODE Z LEVEL set to %d", level)
 }
 
 func DataProc(command string, info []byte, ftp *Ftp) error {
@@ -228,6 +640,14 @@ func DataProc(command string, info []byte, ftp *Ftp) error {
 		return commandPort(info, ftp, ftp)
 	} else if command == "PASV" {
 		return commandPasv(info, ftp, ftp)
+	} else if command == "EPRT" {
+		return commandEprt(info, ftp, ftp)
+	} else if command == "EPSV" {
+		return commandEpsv(info, ftp, ftp)
+	} else if command == "MODE" {
+		return commandMode(info, ftp, ftp)
+	} else if command == "OPTS MODE" {
+		return commandOptsMode(info, ftp, ftp)
 	}
 
 	Fataln(command)
@@ -235,6 +655,12 @@ func DataProc(command string, info []byte, ftp *Ftp) error {
 }
 
 func init() {
-	register("PORT", DataProc)
-	register("PASV", DataProc)
+	register("PORT", stateAuthenticated, DataProc)
+	register("PASV", stateAuthenticated, DataProc)
+	register("EPRT", stateAuthenticated, DataProc)
+	register("EPSV", stateAuthenticated, DataProc)
+	register("MODE", stateAuthenticated, DataProc)
+	registerOpts("MODE", DataProc)
+
+	registerFeat("MODE", func(*Ftp) string { return "MODE Z" })
 }
@@ -1,11 +1,16 @@
 package ftpserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
 	"time"
 )
@@ -17,34 +22,52 @@ var (
 	errPathIsEmpty  = errors.New("Error: Input Path is empty.")
 	errHasBeenRoot  = errors.New("Error: The current path has been in root.")
 	errReadDirs     = errors.New("Error: Read the Dirs has been Error.")
+	errBadPattern   = errors.New("Error: The glob pattern is malformed.")
 )
 
 type EntryDriver interface {
 	/* Operations related to file directories.
 	Enter the folder.Get the current file path.
 	get the current file list information. */
-	SetRootEntry(uid int) error
+	SetRootEntry(string) error
 	EnterEntry(folder string) error
 	GetPwd() string
 	Getlist(folder string) ([]byte, error)
+	Readlist(folder string) ([]os.FileInfo, error)
+	Getnamelist(folder string, pattern string) ([]string, error)
+	Getinfo(path string) (os.FileInfo, error)
 	//DeleteFile(path string) error
 
 	GetRootDir() string
 	GetCurDir() string
+
+	/* the facts selected with "OPTS MLST" */
+	SetMlstFacts([]string)
+	GetMlstFacts() []string
 }
 
 type EntryRequire interface {
-	Response(string) error
-	WaitDataConn()
+	ReplyRequire
+	TransferRequire
 	WriteAll([]byte) error
-	DataClose()
 	CheckAuth(uint) bool
 	GetUserName() string
+	GetUmask() os.FileMode
 }
 
+/* the facts MLST and MLSD report, RFC 3659 section 7 */
+var mlstFacts = []string{"type", "size", "modify", "perm", "unique", "unix.mode"}
+
 type Entry struct {
 	rootPath string
 	curPath  string
+	facts    []string
+}
+
+func NewEntry() *Entry {
+	return &Entry{
+		facts: mlstFacts,
+	}
 }
 
 func isValidDir(folder string) error {
@@ -62,9 +85,7 @@ func isValidDir(folder string) error {
 	return nil
 }
 
-func (entry *Entry) SetRootEntry(uid int) error {
-	var folder = Conf.Users[uid].Root
-
+func (entry *Entry) SetRootEntry(folder string) error {
 	if err := isValidDir(folder); err != nil {
 		return err
 	}
@@ -124,7 +145,7 @@ func (entry *Entry) GetPwd() string {
 	return entry.curPath[len(entry.rootPath):]
 }
 
-func (entry *Entry) Getlist(folder string) ([]byte, error) {
+func (entry *Entry) Readlist(folder string) ([]os.FileInfo, error) {
 	if folder == "" {
 		folder = entry.curPath
 	}
@@ -134,20 +155,92 @@ func (entry *Entry) Getlist(folder string) ([]byte, error) {
 		log.Println(err)
 		return nil, errReadDirs
 	}
+	return dirList, nil
+}
 
-	const time_layet = "Jan 2 15:04"
+func (entry *Entry) Getinfo(path string) (os.FileInfo, error) {
+	f, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errPathNonExist
+		}
+		log.Println(err)
+		return nil, errGetPathStat
+	}
+	return f, nil
+}
+
+func (entry *Entry) Getlist(folder string) ([]byte, error) {
+	dirList, err := entry.Readlist(folder)
+	if err != nil {
+		return nil, err
+	}
 
 	var msg = ""
 	for _, f := range dirList {
-		msg += fmt.Sprintf("%s %5d %4d %4d %8d %s %s\r\n",
-			f.Mode(), 1, 0, 0, f.Size(),
-			time.Unix(f.ModTime().Unix(), 0).Format(time_layet),
-			f.Name())
+		msg += listLine(f)
 	}
 
 	return []byte(msg), nil
 }
 
+/* one "ls -l" style line of LIST */
+func listLine(f os.FileInfo) string {
+	/* like ls, the year replaces the time for old and future files,
+	MFMT makes both common */
+	var time_layet = "Jan _2 15:04"
+	var modTime = time.Unix(f.ModTime().Unix(), 0)
+	if now := time.Now(); modTime.Before(now.AddDate(0, -6, 0)) ||
+		modTime.After(now.Add(time.Hour)) {
+		time_layet = "Jan _2  2006"
+	}
+
+	return fmt.Sprintf("%s %5d %4d %4d %8d %s %s\r\n",
+		f.Mode(), 1, 0, 0, f.Size(), modTime.Format(time_layet), f.Name())
+}
+
+// Getnamelist returns the names in folder matching the shell glob pattern,
+// all names if the pattern is empty. Like a shell, wildcards don't match a
+// leading dot.
+func (entry *Entry) Getnamelist(folder string, pattern string) ([]string, error) {
+	/* a malformed pattern is an error also in an empty dictionary */
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errBadPattern
+	}
+
+	dirList, err := entry.Readlist(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, f := range dirList {
+		if pattern == "" {
+			names = append(names, f.Name())
+			continue
+		}
+
+		if f.Name()[0] == '.' && pattern[0] != '.' {
+			continue
+		}
+		matched, err := path.Match(pattern, f.Name())
+		if err != nil {
+			return nil, errBadPattern
+		}
+		if matched {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+/* without a file id the unique fact falls back to a hash of the path */
+func fileUniqueByPath(path string) string {
+	var h = fnv.New64a()
+	h.Write([]byte(path))
+	return fmt.Sprintf("%x", h.Sum64())
+}
+
 func (entry *Entry) GetRootDir() string {
 	return entry.rootPath
 }
@@ -156,104 +249,343 @@ func (entry *Entry) GetCurDir() string {
 	return entry.curPath
 }
 
+func (entry *Entry) SetMlstFacts(facts []string) {
+	entry.facts = facts
+}
+
+func (entry *Entry) GetMlstFacts() []string {
+	return entry.facts
+}
+
 func commandCwd(info []byte, driver EntryDriver, require EntryRequire) error {
 	if err := driver.EnterEntry(string(info)); err != nil {
 		if err == errPathIsEmpty || err == errPathNonExist {
-			return require.Response(
-				"501 Parameter syntax error.Please Input correct folder path.")
+			return require.Reply(CodeParameterError,
+				"Parameter syntax error.Please Input correct folder path.")
 		} else if err == errNonDirPath {
-			var resMsg = fmt.Sprintf(
-				"501 Parameter syntax error.%s is not a dictionary\r\n",
-				string(info))
-			return require.Response(resMsg)
+			return require.Replyf(CodeParameterError,
+				"Parameter syntax error.%s is not a dictionary", string(info))
 		} else if err == errGetPathStat {
-			return require.Response("451 Has unknown local Error\r\n")
+			return require.Reply(CodeLocalError, "Has unknown local Error")
 		} else {
 			Warnln(err)
 		}
 	}
-	return require.Response("250 Requested File Operation Completed\r\n")
+	return require.Reply(CodeFileActionOK, "Requested File Operation Completed")
 }
 
 func commandCdup(info []byte, driver EntryDriver, require EntryRequire) error {
 	if len(info) != 0 {
-		var resMsg = fmt.Sprintf(
-			"501 Parameter syntax error.Can't idenfy \"%s\"", string(info))
-		return require.Response(resMsg)
+		return require.Replyf(CodeParameterError,
+			"Parameter syntax error.Can't idenfy \"%s\"", string(info))
 	}
 
 	if err := driver.EnterEntry(".."); err != nil {
 		if err == errHasBeenRoot {
-			return require.Response(
-				"550 The operation that did not execute,Has been root dir\r\n")
+			return require.Reply(CodeFileUnavailable,
+				"The operation that did not execute,Has been root dir")
 		} else {
 			Warnln(err)
 		}
 	}
-	return require.Response(
-		"200 Command succeed,Return Parent folder\r\n")
+	return require.Reply(CodeOK,
+		"Command succeed,Return Parent folder")
+}
+
+/* ls style options such as "-la" are accepted and ignored */
+func listArgument(info []byte) string {
+	var arg = strings.TrimSpace(string(info))
+	for strings.HasPrefix(arg, "-") {
+		var index = strings.Index(arg, " ")
+		if index < 0 {
+			return ""
+		}
+		arg = strings.TrimSpace(arg[index+1:])
+	}
+	return arg
 }
 
 func commandList(info []byte, driver EntryDriver, require EntryRequire) error {
-	var list, err = driver.Getlist(string(info))
+	var folder = listArgument(info)
+	if folder != "" {
+		folder = realPath(folder, driver)
+	}
+
+	var list, err = driver.Getlist(folder)
 	if err != nil {
 		if err == errReadDirs {
-			return require.Response(
-				"451 Has unknown local Error.Get dictionary Error\r\n")
+			return require.Reply(CodeLocalError,
+				"Has unknown local Error.Get dictionary Error")
 		} else {
 			Warnln(err)
 		}
 	}
 
-	require.WaitDataConn()
+	return runTransfer(require, "LIST "+string(info),
+		require.Translate("Opening data connection for LIST"),
+		func(context.Context) error {
+			return require.WriteAll(list)
+		})
+}
+
+func commandNlst(info []byte, driver EntryDriver, require EntryRequire) error {
+	var arg = listArgument(info)
+	var folder = driver.GetCurDir()
+	var prefix, pattern = "", ""
+
+	if strings.ContainsAny(path.Base(arg), "*?[") {
+		/* the glob only applies to the last path element */
+		var index = strings.LastIndex(arg, "/")
+		if index >= 0 {
+			prefix = arg[:index+1]
+			folder = realPath(prefix, driver)
+		}
+		pattern = arg[index+1:]
+	} else if arg != "" {
+		var full = realPath(arg, driver)
+		var f, err = driver.Getinfo(full)
+		if err == errPathNonExist {
+			return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+				"The file or dictionary is not exist")
+		} else if err != nil {
+			return require.Reply(CodeLocalError, "Has unknown local Error")
+		}
+
+		if f.IsDir() {
+			folder = full
+			prefix = strings.TrimRight(arg, "/") + "/"
+		} else {
+			pattern = f.Name()
+			folder = path.Dir(full)
+			prefix = arg[:len(arg)-len(path.Base(arg))]
+		}
+	}
+
+	if err := isValidDir(folder); err == errPathNonExist || err == errNonDirPath {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The dictionary is not exist")
+	} else if err != nil {
+		return require.Reply(CodeLocalError, "Has unknown local Error")
+	}
+
+	var names, err = driver.Getnamelist(folder, pattern)
+	if err == errBadPattern {
+		return require.Reply(CodeParameterError, "Parameter syntax error."+
+			"Can't idenfy the glob pattern")
+	} else if err != nil {
+		return require.Reply(CodeLocalError,
+			"Has unknown local Error.Get dictionary Error")
+	}
+
+	/* an empty dictionary is an empty list, only a glob can miss */
+	if len(names) == 0 && pattern != "" {
+		return require.Reply(CodeFileActionNotTaken, "No files found")
+	}
+
+	var list = ""
+	for _, name := range names {
+		list += prefix + name + "\r\n"
+	}
+
+	return runTransfer(require, "NLST "+string(info),
+		require.Translate("Opening data connection for NLST"),
+		func(context.Context) error {
+			return require.WriteAll([]byte(list))
+		})
+}
 
-	if err := require.WriteAll(list); err != nil {
-		return require.Response(
-			"550 The operation that did not execute, data connection error\r\n")
+/* the perm fact tells the client up front what this user may do */
+func mlstPerm(f os.FileInfo, require EntryRequire) string {
+	var perm = ""
+	var addPerm = func(auth uint, flag string) {
+		if require.CheckAuth(auth) {
+			perm += flag
+		}
 	}
 
-	require.DataClose()
+	if f.IsDir() {
+		perm += "el"
+		addPerm(PUT, "c")
+		addPerm(MKDIR, "m")
+		addPerm(DELDIR, "d")
+		addPerm(DELETE, "p")
+	} else {
+		addPerm(GET, "r")
+		if require.CheckAuth(PUT) && require.CheckAuth(RECOVER) {
+			perm += "w"
+		}
+		addPerm(APPEND, "a")
+		addPerm(DELETE, "d")
+	}
+	addPerm(RENAME, "f")
+	return perm
+}
 
-	return require.Response(
-		"226 Close the data connection, the requested file operation is successful\r\n")
+func mlstLine(f os.FileInfo, path string, name string,
+	facts []string, require EntryRequire) string {
+	var line = ""
+	for _, fact := range facts {
+		switch fact {
+		case "type":
+			if f.IsDir() {
+				line += "type=dir;"
+			} else {
+				line += "type=file;"
+			}
+		case "size":
+			line += fmt.Sprintf("size=%d;", f.Size())
+		case "modify":
+			line += "modify=" + f.ModTime().UTC().Format("20060102150405") + ";"
+		case "perm":
+			line += "perm=" + mlstPerm(f, require) + ";"
+		case "unique":
+			line += "unique=" + fileUnique(f, path) + ";"
+		case "unix.mode":
+			line += fmt.Sprintf("unix.mode=0%o;", f.Mode().Perm())
+		}
+	}
+	return line + " " + name + "\r\n"
+}
+
+func commandMlst(info []byte, driver EntryDriver, require EntryRequire) error {
+	var name = string(info)
+	if name == "" {
+		name = "."
+	}
+
+	var path = realPath(name, driver)
+	var f, err = driver.Getinfo(path)
+	if err == errPathNonExist {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file or dictionary is not exist")
+	} else if err != nil {
+		return require.Reply(CodeLocalError, "Has unknown local Error")
+	}
+
+	/* the pathname the client sees, relative to the user's root */
+	var pathname = path[len(driver.GetRootDir()):]
+
+	var reply = NewMultiReply(CodeFileActionOK, "Listing %s", pathname)
+	reply.Line(mlstLine(f, path, pathname, driver.GetMlstFacts(), require))
+	return require.ReplyMulti(reply, "End")
+}
+
+func commandMlsd(info []byte, driver EntryDriver, require EntryRequire) error {
+	var name = string(info)
+	if name == "" {
+		name = "."
+	}
+
+	var folder = realPath(name, driver)
+	if err := isValidDir(folder); err == errNonDirPath {
+		return require.Reply(CodeParameterError, "Parameter syntax error."+
+			"This is not a dictionary")
+	} else if err == errPathNonExist {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The dictionary is not exist")
+	} else if err != nil {
+		return require.Reply(CodeLocalError, "Has unknown local Error")
+	}
+
+	var dirList, err = driver.Readlist(folder)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Has unknown local Error.Get dictionary Error")
+	}
+
+	var list = ""
+	for _, f := range dirList {
+		list += mlstLine(f, folder+"/"+f.Name(), f.Name(),
+			driver.GetMlstFacts(), require)
+	}
+
+	return runTransfer(require, "MLSD "+string(info),
+		require.Translate("Opening data connection for MLSD"),
+		func(context.Context) error {
+			return require.WriteAll([]byte(list))
+		})
+}
+
+func commandOptsMlst(info []byte, driver EntryDriver, require EntryRequire) error {
+	var selected = strings.Split(strings.ToLower(string(info)), ";")
+
+	/* unknown facts are ignored, the known ones keep their order */
+	var facts []string
+	for _, fact := range mlstFacts {
+		for _, name := range selected {
+			if fact == name {
+				facts = append(facts, fact)
+				break
+			}
+		}
+	}
+
+	driver.SetMlstFacts(facts)
+
+	var msg = "MLST OPTS "
+	for _, fact := range facts {
+		msg += fact + ";"
+	}
+	return require.Reply(CodeOK, msg)
+}
+
+/* "MLST type*;size*;..." with the facts of this session marked */
+func featMlst(ftp *Ftp) string {
+	var feat = "MLST "
+	for _, fact := range mlstFacts {
+		feat += fact
+		for _, selected := range ftp.GetMlstFacts() {
+			if fact == selected {
+				feat += "*"
+				break
+			}
+		}
+		feat += ";"
+	}
+	return feat
+}
+
+/* RFC 959 appendix II: 257 quotes the path, doubling the quotes in it */
+func quotePath(pathname string) string {
+	return "\"" + strings.Replace(pathname, "\"", "\"\"", -1) + "\""
 }
 
 func commandPwd(info []byte, driver EntryDriver, require EntryRequire) error {
-	return require.Response(
-		fmt.Sprintf("257 %s\r\n", driver.GetPwd()))
+	return require.Replyf(CodePathCreated,
+		"%s is the current dictionary", quotePath(path.Clean(driver.GetPwd())))
 }
 
 func mkdirAndDelDirCheck(info []byte, driver EntryDriver,
 	require EntryRequire, auth uint) (bool, error) {
 	if len(info) == 0 {
-		return false, require.Response("501 Parameter syntax error." +
-			"Please input dictionary name\r\n")
+		return false, require.Reply(CodeParameterError, "Parameter syntax error."+
+			"Please input dictionary name")
 	} else if len(info) > 256 {
-		return false, require.Response("550 The operation that did not execute." +
-			"Dictionary name too long\r\n")
+		return false, require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"Dictionary name too long")
 	}
 
 	if !require.CheckAuth(auth) {
-		return false, require.Response("530 Parameter denied\r\n")
+		return false, require.Reply(CodeNotLoggedIn, "Parameter denied")
 	}
 
 	if strings.Contains(string(info), "../") {
 		/* for security. Preventive use "../" Return to the upper directory.*/
-		return false, require.Response("550 The operation that did not execute." +
-			"Including \"../\" is not supported\r\n")
+		return false, require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"Including \"../\" is not supported")
 	}
 
 	var dirName = driver.GetCurDir() + string(info)
 	if err := isValidDir(dirName); err == errGetPathStat {
-		return false, require.Response("451 Abort the operation of the request\r\n")
+		return false, require.Reply(CodeLocalError, "Abort the operation of the request")
 
 	} else if (err == nil || err == errNonDirPath) && auth == MKDIR {
-		return false, require.Response("550 The operation that did not execute." +
-			"The dictionary has been exist\r\n")
+		return false, require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The dictionary has been exist")
 
-	} else if err == errNonDirPath && auth == DELDIR {
-		return false, require.Response("550 The operation that did not execute." +
-			"The dictionary has no been exist\r\n")
+	} else if (err == errNonDirPath || err == errPathNonExist) && auth != MKDIR {
+		return false, require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The dictionary has no been exist")
 
 	}
 
@@ -266,12 +598,13 @@ func commandMkr(info []byte, driver EntryDriver, require EntryRequire) error {
 	}
 
 	var dirName = driver.GetCurDir() + string(info)
-	if err := os.Mkdir(dirName, os.ModePerm); err != nil {
+	if err := os.Mkdir(dirName, os.ModePerm&^require.GetUmask()); err != nil {
 		Warnln(err)
-		return require.Response("451 Abort the operation of the request\r\n")
+		return require.Reply(CodeLocalError, "Abort the operation of the request")
 	} else {
 		Debugln(require.GetUserName() + " create dictionary " + dirName)
-		return require.Response("257 Create dictionary succeed\r\n")
+		return require.Replyf(CodePathCreated, "%s created",
+			quotePath(path.Join(driver.GetPwd(), string(info))))
 	}
 }
 
@@ -280,14 +613,113 @@ func commandRmd(info []byte, driver EntryDriver, require EntryRequire) error {
 		return err
 	}
 
+	/* RMD only removes empty dictionaries, RMDA removes the whole tree */
 	var dirName = driver.GetCurDir() + string(info)
-	if err := os.RemoveAll(dirName); err != nil {
+	if empty, err := isEmptyDir(dirName); err != nil {
 		Warnln(err)
-		return require.Response("451 Abort the operation of the request\r\n")
+		return require.Reply(CodeLocalError, "Abort the operation of the request")
+	} else if !empty {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The dictionary is not empty")
+	}
+
+	if err := os.Remove(dirName); err != nil {
+		Warnln(err)
+		return require.Reply(CodeLocalError, "Abort the operation of the request")
 	} else {
 		Debugln(require.GetUserName() + " delete dictionary " + dirName)
-		return require.Response("250 Delete dictionary succeed\r\n")
+		return require.Reply(CodeFileActionOK, "Delete dictionary succeed")
+	}
+}
+
+func isEmptyDir(folder string) (bool, error) {
+	f, err := os.Open(folder)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Readdirnames(1); err == io.EOF {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// removeTree removes folder with everything in it, the deepest entries
+// first. Symbolic links are unlinked at any level, never followed. It
+// returns how many entries it removed, folder included, also when it
+// stops at an error.
+func removeTree(folder string) (int, error) {
+	f, err := os.Lstat(folder)
+	if err != nil {
+		return 0, err
+	}
+	if !f.IsDir() {
+		if err := os.Remove(folder); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	}
+
+	var count = 0
+	names, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return count, err
+	}
+
+	for _, f := range names {
+		n, err := removeTree(path.Join(folder, f.Name()))
+		count += n
+		if err != nil {
+			return count, err
+		}
+	}
+
+	if err := os.Remove(folder); err != nil {
+		return count, err
+	}
+	return count + 1, nil
+}
+
+/* whether a link in the dictionaries above folder leads out of root */
+func outsideRoot(folder string, root string) bool {
+	parent, err := filepath.EvalSymlinks(path.Dir(folder))
+	if err != nil {
+		return true
+	}
+	root, err = filepath.EvalSymlinks(root)
+	if err != nil {
+		return true
+	}
+	return parent != root && !strings.HasPrefix(parent, root+"/")
+}
+
+/* RMDA and SITE RMDIR -r, the recursive RMD of the deltree permission */
+func commandRmda(info []byte, driver EntryDriver, require EntryRequire) error {
+	if ok, err := mkdirAndDelDirCheck(info, driver, require, DELTREE); !ok {
+		return err
+	}
+
+	/* never the root or, through "..", anything above it */
+	var dirName = path.Clean(driver.GetCurDir() + string(info))
+	if !strings.HasPrefix(dirName, path.Clean(driver.GetRootDir())+"/") {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The root dictionary can't be removed")
+	} else if outsideRoot(dirName, driver.GetRootDir()) {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The dictionary is outside the root")
+	}
+
+	count, err := removeTree(dirName)
+	Debugln(require.GetUserName()+" delete dictionary tree "+dirName, count)
+	if err != nil {
+		Warnln(err)
+		return require.Replyf(CodeLocalError,
+			"Abort the operation of the request, %d entries removed", count)
 	}
+	return require.Replyf(CodeFileActionOK, "Delete dictionary tree succeed, %d entries removed", count)
 }
 
 func DirProc(command string, info []byte, ftp *Ftp) error {
@@ -304,16 +736,35 @@ func DirProc(command string, info []byte, ftp *Ftp) error {
 		return commandMkr(info, ftp, ftp)
 	} else if command == "RMD" {
 		return commandRmd(info, ftp, ftp)
+	} else if command == "RMDA" {
+		return commandRmda(info, ftp, ftp)
+	} else if command == "NLST" {
+		return commandNlst(info, ftp, ftp)
+	} else if command == "MLST" {
+		return commandMlst(info, ftp, ftp)
+	} else if command == "MLSD" {
+		return commandMlsd(info, ftp, ftp)
+	} else if command == "OPTS MLST" {
+		return commandOptsMlst(info, ftp, ftp)
 	}
 	Fataln()
 	return nil
 }
 
 func init() {
-	register("CDUP", DirProc)
-	register("CWD", DirProc)
-	register("LIST", DirProc)
-	register("PWD", DirProc)
-	register("MKD", DirProc)
-	register("RMD", DirProc)
+	register("CDUP", stateAuthenticated, DirProc)
+	register("CWD", stateAuthenticated, DirProc)
+	register("LIST", stateAuthenticated, DirProc)
+	register("PWD", stateAuthenticated, DirProc)
+	register("MKD", stateAuthenticated, DirProc)
+	register("RMD", stateAuthenticated, DirProc)
+	register("RMDA", stateAuthenticated, DirProc)
+	register("NLST", stateAuthenticated, DirProc)
+	register("MLST", stateAuthenticated, DirProc)
+	register("MLSD", stateAuthenticated, DirProc)
+	registerOpts("MLST", DirProc)
+
+	registerFeat("MLST", featMlst)
+	/* MLSD is covered by the MLST feature */
+	registerFeat("MLSD", func(*Ftp) string { return "" })
 }
@@ -0,0 +1,102 @@
+package ftpserver
+
+import (
+	"sort"
+	"strings"
+)
+
+// featFn returns the FEAT line of a command. Commands without one are
+// advertised by name, an empty line hides the command.
+type featFn func(*Ftp) string
+
+var featModules = make(map[string]featFn)
+
+/* OPTS sub-commands, dispatched as "OPTS <name>" */
+var optsModules = make(map[string]cmdFn)
+
+/* RFC 959 commands every server has, FEAT doesn't list them */
+var baseCommands = map[string]bool{
+	"USER": true, "PASS": true, "ACCT": true, "CWD": true, "CDUP": true,
+	"SMNT": true, "QUIT": true, "REIN": true, "PORT": true, "PASV": true,
+	"TYPE": true, "STRU": true, "MODE": true, "RETR": true, "STOR": true,
+	"STOU": true, "APPE": true, "ALLO": true, "REST": true, "RNFR": true,
+	"RNTO": true, "ABOR": true, "DELE": true, "RMD": true, "MKD": true,
+	"PWD": true, "LIST": true, "NLST": true, "SITE": true, "SYST": true,
+	"STAT": true, "HELP": true, "NOOP": true, "FEAT": true,
+}
+
+func registerFeat(command string, fn featFn) {
+	if _, ok := featModules[command]; ok {
+		Fataln("Repeated registration：", command)
+	}
+	featModules[command] = fn
+}
+
+func registerOpts(option string, fn cmdFn) {
+	if _, ok := optsModules[option]; ok {
+		Fataln("Repeated registration：", option)
+	}
+	optsModules[option] = fn
+}
+
+func commandFeat(ftp *Ftp) error {
+	var commands []string
+	for command := range cmdModules {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	var reply = NewMultiReply(CodeSystemStatus, "Features:")
+	for _, command := range commands {
+		var feat = command
+		if fn, ok := featModules[command]; ok {
+			feat = fn(ftp)
+		} else if baseCommands[command] {
+			continue
+		}
+
+		if feat != "" {
+			reply.Line(feat)
+		}
+	}
+	return ftp.ReplyMulti(reply, "End")
+}
+
+func commandOpts(info []byte, ftp *Ftp) error {
+	var option, args = decode(info)
+	option = strings.ToUpper(option)
+
+	if fn, ok := optsModules[option]; ok {
+		return fn("OPTS "+option, args, ftp)
+	}
+	return ftp.Reply(CodeParameterError, "Option not understood")
+}
+
+func commandOptsUtf8(info []byte, ftp *Ftp) error {
+	/* paths are passed through as bytes, UTF-8 is always on */
+	switch strings.ToUpper(string(info)) {
+	case "", "ON":
+		return ftp.Reply(CodeOK, "UTF8 set to on")
+	}
+	return ftp.Reply(CodeParameterNotImplemented, "UTF8 can't be turned off")
+}
+
+func FeatProc(command string, info []byte, ftp *Ftp) error {
+	if command == "FEAT" {
+		return commandFeat(ftp)
+	} else if command == "OPTS" {
+		return commandOpts(info, ftp)
+	} else if command == "OPTS UTF8" {
+		return commandOptsUtf8(info, ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("FEAT", stateIdle, FeatProc)
+	register("OPTS", stateIdle, FeatProc)
+	registerOpts("UTF8", FeatProc)
+
+	registerFeat("OPTS", func(*Ftp) string { return "UTF8" })
+}
@@ -1,10 +1,16 @@
 package ftpserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
@@ -15,29 +21,79 @@ var (
 	errFileTransfer    = errors.New("File transfer unknown error.")
 	errFileReciver     = errors.New("File receive unknown error.")
 	errFileCreate      = errors.New("File create error.")
+	errFileSeek        = errors.New("File seek error.")
+	errFileCreateTime  = errors.New("Creation time is not supported.")
 )
 
 type FileDriver interface {
 	FileIsExist(path string) error
 	GetFileSize(string) (int64, error)
-	Sendfile(string, io.Writer) error
-	Recvfile(string, io.Reader) error
+	GetModTime(string) (time.Time, error)
+	SetModTime(string, time.Time) error
+	SetCreateTime(string, time.Time) error
+	Sendfile(string, int64, io.Writer) error
+	Recvfile(string, int64, io.Reader) error
+	Appendfile(string, io.Reader) error
+	Uniquefile(string) (string, error)
+	Hashfile(string, int64, int64, hash.Hash) error
+
+	/* the REST restart marker for the next transfer */
+	SetRestart(int64)
+	GetRestart() int64
+
+	/* the RNFR source waiting for RNTO */
+	SetRenameFrom(string)
+	GetRenameFrom() string
+
+	/* TYPE A converts line endings in Sendfile and Recvfile */
+	SetAscii(bool)
+	IsAscii() bool
+
+	/* the HASH algorithm chosen with OPTS HASH */
+	SetHashAlgo(string)
+	GetHashAlgo() string
+
+	/* SITE UMASK, masks the mode of new files and dictionaries */
+	SetUmask(os.FileMode)
+	GetUmask() os.FileMode
 }
 
 type FileRequire interface {
-	Response(string) error
+	ReplyRequire
 	GetCurDir() string
 	GetRootDir() string
 	GetUserName() string
 	CheckAuth(uint) bool
 
-	WaitDataConn()
+	TransferRequire
 	Write(msg []byte) (int, error)
 	Read(msg []byte) (int, error)
-	DataClose()
+}
+
+type PathRequire interface {
+	GetCurDir() string
+	GetRootDir() string
 }
 
 type File struct {
+	restart    int64
+	renameFrom string
+	ascii      bool
+	hashAlgo   string
+	umask      os.FileMode
+}
+
+func NewFile() *File {
+	return &File{umask: Conf.Ftp_umask_mode}
+}
+
+// realPath resolves a client path against the current dictionary. The
+// result always stays inside the user's root, "../" can't climb out of it.
+func realPath(name string, require PathRequire) string {
+	if name[0] != '/' {
+		name = require.GetCurDir()[len(require.GetRootDir()):] + name
+	}
+	return require.GetRootDir() + path.Clean("/"+name)
 }
 
 func (file *File) FileIsExist(path string) error {
@@ -73,7 +129,31 @@ func (file *File) GetFileSize(path string) (int64, error) {
 	return stat.Size(), nil
 }
 
-func (file *File) Sendfile(path string, writer io.Writer) error {
+func (file *File) GetModTime(path string) (time.Time, error) {
+	if err := file.FileIsExist(path); err != nil {
+		return time.Time{}, err
+	}
+
+	var stat, err = os.Stat(path)
+	if err != nil {
+		Warnln("Unknown system error", err)
+		return time.Time{}, errFileUnkSystem
+	}
+
+	return stat.ModTime(), nil
+}
+
+/* the access time is left as it is */
+func (file *File) SetModTime(path string, modTime time.Time) error {
+	return os.Chtimes(path, time.Time{}, modTime)
+}
+
+/* errFileCreateTime where the filesystem has no creation time to set */
+func (file *File) SetCreateTime(path string, createTime time.Time) error {
+	return setCreateTime(path, createTime)
+}
+
+func (file *File) Sendfile(path string, offset int64, writer io.Writer) error {
 
 	if err := file.FileIsExist(path); err != nil {
 		return err
@@ -84,6 +164,16 @@ func (file *File) Sendfile(path string, writer io.Writer) error {
 		Warnln(err)
 		return errFileUnkSystem
 	}
+	defer reader.Close()
+
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		Warnln(err)
+		return errFileSeek
+	}
+
+	if file.ascii {
+		writer = &crlfWriter{writer: writer}
+	}
 
 	_, err = io.Copy(writer, reader)
 	if err != nil {
@@ -94,144 +184,605 @@ func (file *File) Sendfile(path string, writer io.Writer) error {
 	return nil
 }
 
-func (file *File) Recvfile(path string, reader io.Reader) error {
-	var writer, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0664)
+// Hashfile streams length bytes from offset into h, up to the end of the
+// file if length is negative. The bytes are hashed as stored, TYPE A
+// doesn't apply.
+func (file *File) Hashfile(path string, offset int64, length int64, h hash.Hash) error {
+	if err := file.FileIsExist(path); err != nil {
+		return err
+	}
+
+	reader, err := os.Open(path)
 	if err != nil {
 		Warnln(err)
-		return errFileCreate
+		return errFileUnkSystem
 	}
+	defer reader.Close()
 
-	_, err = io.Copy(writer, reader)
-	if err != nil {
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		Warnln(err)
+		return errFileSeek
+	}
+
+	if length < 0 {
+		_, err = io.Copy(h, reader)
+	} else {
+		_, err = io.CopyN(h, reader, length)
+	}
+	if err != nil && err != io.EOF {
+		Warnln(err)
+		return errFileUnkSystem
+	}
+	return nil
+}
+
+/* copy an upload into the opened file, converting line endings in TYPE A */
+func (file *File) copyIn(writer *os.File, reader io.Reader) error {
+	if !file.ascii {
+		if _, err := io.Copy(writer, reader); err != nil {
+			Warnln(err)
+			return errFileReciver
+		}
+		return nil
+	}
+
+	var lf = &lfWriter{writer: writer}
+	if _, err := io.Copy(lf, reader); err != nil {
+		Warnln(err)
+		return errFileReciver
+	}
+	if err := lf.Flush(); err != nil {
 		Warnln(err)
 		return errFileReciver
 	}
 	return nil
 }
 
+func (file *File) Recvfile(path string, offset int64, reader io.Reader) error {
+	var writer, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666&^file.umask)
+	if err != nil {
+		Warnln(err)
+		return errFileCreate
+	}
+	defer writer.Close()
+
+	/* resume: drop whatever followed the restart marker and continue there */
+	if offset > 0 {
+		if err := writer.Truncate(offset); err != nil {
+			Warnln(err)
+			return errFileSeek
+		}
+		if _, err := writer.Seek(offset, io.SeekStart); err != nil {
+			Warnln(err)
+			return errFileSeek
+		}
+	}
+
+	return file.copyIn(writer, reader)
+}
+
+func (file *File) Appendfile(path string, reader io.Reader) error {
+	var writer, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666&^file.umask)
+	if err != nil {
+		Warnln(err)
+		return errFileCreate
+	}
+	defer writer.Close()
+
+	return file.copyIn(writer, reader)
+}
+
+func (file *File) SetRestart(offset int64) {
+	file.restart = offset
+}
+
+func (file *File) GetRestart() int64 {
+	return file.restart
+}
+
+// Uniquefile creates an empty file named base, base.1, base.2 ... whichever
+// doesn't exist yet. O_EXCL reserves the name against concurrent uploads.
+func (file *File) Uniquefile(base string) (string, error) {
+	const max_tries = 1000
+
+	for i := 0; i < max_tries; i++ {
+		var path = base
+		if i > 0 {
+			path = base + "." + strconv.Itoa(i)
+		}
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666&^file.umask)
+		if err == nil {
+			f.Close()
+			return path, nil
+		}
+		if !os.IsExist(err) {
+			Warnln(err)
+			return "", errFileCreate
+		}
+	}
+	return "", errFileCreate
+}
+
+func (file *File) SetAscii(ascii bool) {
+	file.ascii = ascii
+}
+
+func (file *File) IsAscii() bool {
+	return file.ascii
+}
+
+func (file *File) SetUmask(umask os.FileMode) {
+	file.umask = umask
+}
+
+func (file *File) GetUmask() os.FileMode {
+	return file.umask
+}
+
+func (file *File) SetHashAlgo(algo string) {
+	file.hashAlgo = algo
+}
+
+func (file *File) GetHashAlgo() string {
+	if file.hashAlgo == "" {
+		return defaultHashAlgo
+	}
+	return file.hashAlgo
+}
+
+func (file *File) SetRenameFrom(path string) {
+	file.renameFrom = path
+}
+
+func (file *File) GetRenameFrom() string {
+	return file.renameFrom
+}
+
+func transferType(driver FileDriver) string {
+	if driver.IsAscii() {
+		return "ASCII"
+	}
+	return "Binary"
+}
+
+/* TYPE A [N] and TYPE I, L 8 is the same as I */
+func commandType(info []byte, driver FileDriver, require FileRequire) error {
+	var args = strings.Fields(strings.ToUpper(string(info)))
+	if len(args) == 0 || len(args) > 2 {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input a type")
+	}
+
+	switch {
+	case args[0] == "A" && (len(args) == 1 || args[1] == "N"):
+		driver.SetAscii(true)
+		return require.Reply(CodeOK, "Type set to A")
+	case args[0] == "I" && len(args) == 1,
+		args[0] == "L" && len(args) == 2 && args[1] == "8":
+		driver.SetAscii(false)
+		return require.Reply(CodeOK, "Type set to I")
+	case args[0] == "A", args[0] == "E", args[0] == "L":
+		return require.Reply(CodeParameterNotImplemented, "Command not implemented for that parameter")
+	}
+	return require.Reply(CodeParameterError, "Parameter syntax error.Unknown type")
+}
+
+func commandRest(info []byte, driver FileDriver, require FileRequire) error {
+	var offset, err = strconv.ParseInt(string(info), 10, 64)
+	if err != nil || offset < 0 {
+		return require.Reply(CodeParameterError,
+			"Parameter syntax error.Please input a restart offset")
+	}
+
+	driver.SetRestart(offset)
+	return require.Replyf(CodeFileActionPending,
+		"Restarting at %d. Send STOR or RETR to initiate transfer", offset)
+}
+
 func commandRetr(info []byte, driver FileDriver, require FileRequire) error {
 	if len(info) == 0 {
-		return require.Response(
-			"501 Parameter syntax error.Please input file name\r\n")
+		return require.Reply(CodeParameterError,
+			"Parameter syntax error.Please input file name")
 	}
 
 	if !require.CheckAuth(GET) {
 		Debugln(require.GetUserName() + " Has No Permisson To Get File.")
-		return require.Response("530 Permission denied\r\n")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
 	}
 
-	var path string
-	if info[0] == '/' {
-		path = require.GetRootDir() + string(info)
-	} else {
-		path = require.GetCurDir() + string(info)
-	}
+	var path = realPath(string(info), require)
 
 	var size, err = driver.GetFileSize(string(path))
 	if err == errFileNonExist {
-		return require.Response(fmt.Sprintf(
-			"501 Parameter syntax error.Please input correctly file name\r\n"))
+		return require.Replyf(CodeParameterError,
+			"Parameter syntax error.Please input correctly file name")
 	} else if err == errFileSameNameDir {
-		return require.Response(fmt.Sprintf(
-			"501 Parameter syntax error.This is a dictionary\r\n"))
+		return require.Replyf(CodeParameterError,
+			"Parameter syntax error.This is a dictionary")
 	} else if err == errFileUnkSystem {
-		return require.Response(fmt.Sprintf(
-			"451 Abort the operation of the request,there are local errors\r\n"))
+		return require.Replyf(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
 	}
 
-	var msg = fmt.Sprintf("150 opeing %s mode data"+
-		"connection for %s (%dbytes)\r\n",
-		"Binary", string(info), size)
-
-	if err := require.Response(msg); err != nil {
-		return err
+	var offset = driver.GetRestart()
+	if offset > size {
+		return require.Replyf(CodeActionNotTaken,
+			"Invalid REST parameter.The file has only %d bytes", size)
 	}
 
-	require.WaitDataConn()
-	if err := driver.Sendfile(path, require); err != nil {
-		return require.Response("451 Abort the operation." + err.Error() + "\r\n")
-	}
-	require.DataClose()
+	var msg = fmt.Sprintf(require.Translate(
+		"Opening %s mode data connection for %s (%d bytes)"),
+		transferType(driver), string(info), size-offset)
 
-	return require.Response(
-		"226 Close the data connection, the requested file operation is successful\r\n")
+	return runTransfer(require, "RETR "+string(info), msg,
+		func(ctx context.Context) error {
+			return driver.Sendfile(path, offset, contextWriter{ctx, require})
+		})
 }
 
 func commandStor(info []byte, driver FileDriver, require FileRequire) error {
 	if len(info) == 0 {
-		return require.Response(fmt.Sprintf(
-			"501 Parameter syntax error.Please input file name\r\n"))
+		return require.Replyf(CodeParameterError,
+			"Parameter syntax error.Please input file name")
 	}
 
 	if !require.CheckAuth(PUT) {
 		Debugln(require.GetUserName() + " Has No Permisson To Put File.")
-		return require.Response("530 Permission denied\r\n")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
 	}
 
-	var path string
-	if info[0] == '/' {
-		path = require.GetRootDir() + string(info)
-	} else {
-		path = require.GetCurDir() + string(info)
-	}
+	var path = realPath(string(info), require)
+
+	var offset = driver.GetRestart()
 
 	err := driver.FileIsExist(path)
 	/* the file has been exist */
-	if err == nil {
+	if err == nil && offset > 0 {
+		/* resuming writes into the existing file */
+		if !require.CheckAuth(RECOVER) {
+			Debugln(require.GetUserName() + " Has No Permisson To Resume File.")
+			return require.Reply(CodeNotLoggedIn, "Permission deny."+
+				"Resuming an existing file needs recover permission")
+		}
+
+		if size, err := driver.GetFileSize(path); err != nil {
+			return require.Reply(CodeLocalError,
+				"Abort the operation of the request,there are local errors")
+		} else if offset > size {
+			return require.Replyf(CodeActionNotTaken,
+				"Invalid REST parameter.The file has only %d bytes", size)
+		}
+	} else if err == nil {
 		if !require.CheckAuth(RECOVER) {
 			Debugln(require.GetUserName() + " Has No Permisson To Recover File.")
-			return require.Response("530 Permission deny.The same file already exists\r\n")
+			return require.Reply(CodeNotLoggedIn, "Permission deny.The same file already exists")
 		}
 
 		/* delete the file*/
 		if err := os.Remove(path); err != nil {
 			Debugln("Recover File " + path + " from " + require.GetUserName())
-			return require.Response(
-				"451 Abort the operation of the request,there are local errors\r\n")
+			return require.Reply(CodeLocalError,
+				"Abort the operation of the request,there are local errors")
 		}
 	} else if err == errFileUnkSystem {
-		return require.Response(
-			"451 Abort the operation of the request,there are local errors\r\n")
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
 	} else if err == errFileSameNameDir {
-		return require.Response("550 The operation that did not execute." +
-			"The same dictionary already exists\r\n")
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The same dictionary already exists")
+	} else if offset > 0 {
+		return require.Reply(CodeActionNotTaken,
+			"Invalid REST parameter.The file does not exist")
 	}
 
-	var msg = fmt.Sprintf("150 opeing %s mode data"+
-		"connection for %s \r\n", "Binary", string(info))
-	if err := require.Response(msg); err != nil {
+	var msg = fmt.Sprintf(require.Translate(
+		"Opening %s mode data connection for %s"), transferType(driver), string(info))
+
+	return runTransfer(require, "STOR "+string(info), msg,
+		func(ctx context.Context) error {
+			if err := driver.Recvfile(path, offset, contextReader{ctx, require}); err != nil {
+				/* keep the partial file for users who may resume it with REST */
+				if !require.CheckAuth(RECOVER) {
+					_ = os.Remove(path)
+				}
+				Warnln("Write file Failed", err)
+				return err
+			}
+
+			Debugln("Receive File " + path + " from " + require.GetUserName())
+			return nil
+		})
+}
+
+/* SIZE and MDTM answer the same questions RETR asks before downloading */
+func fileStatCheck(info []byte, driver FileDriver, require FileRequire) (string, error) {
+	if len(info) == 0 {
+		return "", require.Reply(CodeParameterError,
+			"Parameter syntax error.Please input file name")
+	}
+
+	if !require.CheckAuth(GET) {
+		Debugln(require.GetUserName() + " Has No Permisson To Get File.")
+		return "", require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	var path = realPath(string(info), require)
+	if err := driver.FileIsExist(path); err == errFileNonExist {
+		return "", require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file is not exist")
+	} else if err == errFileSameNameDir {
+		return "", require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"This is a dictionary")
+	} else if err != nil {
+		return "", require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+	return path, nil
+}
+
+func commandSize(info []byte, driver FileDriver, require FileRequire) error {
+	var path, err = fileStatCheck(info, driver, require)
+	if path == "" {
+		return err
+	}
+
+	size, err := driver.GetFileSize(path)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+	return require.Replyf(CodeFileStatus, "%d", size)
+}
+
+func commandMdtm(info []byte, driver FileDriver, require FileRequire) error {
+	var path, err = fileStatCheck(info, driver, require)
+	if path == "" {
+		return err
+	}
+
+	modTime, err := driver.GetModTime(path)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	/* RFC 3659 time-val, always UTC */
+	return require.Reply(CodeFileStatus,
+		modTime.UTC().Format("20060102150405"))
+}
+
+/* the RFC 3659 time-val, fractions of a second are kept */
+func parseTimeVal(value string) (time.Time, error) {
+	if len(value) < 14 {
+		return time.Time{}, errors.New("Bad time-val " + value)
+	}
+	return time.ParseInLocation("20060102150405", value, time.UTC)
+}
+
+/* the timestamp commands share the permission and the target checks */
+func fileTimeCheck(name string, require FileRequire) (string, error) {
+	if name == "" {
+		return "", require.Reply(CodeParameterError,
+			"Parameter syntax error.Please input file name")
+	}
+
+	if !require.CheckAuth(SETTIME) {
+		Debugln(require.GetUserName() + " Has No Permisson To Set File Time.")
+		return "", require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	var path = realPath(name, require)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return "", require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file or dictionary is not exist")
+	} else if err != nil {
+		Warnln(err)
+		return "", require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+	return path, nil
+}
+
+/* draft-somers-ftp-mfxx: MFMT and MFCT take "time-val path" */
+func commandMfxt(command string, info []byte, driver FileDriver,
+	require FileRequire) error {
+
+	var args = strings.SplitN(string(info), " ", 2)
+	if len(args) != 2 {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input time and file name")
+	}
+
+	var value, err = parseTimeVal(args[0])
+	if err != nil {
+		return require.Replyf(CodeParameterError, "Parameter syntax error.%s", err.Error())
+	}
+
+	path, err := fileTimeCheck(args[1], require)
+	if path == "" {
 		return err
 	}
 
-	require.WaitDataConn()
-	if err := driver.Recvfile(path, require); err != nil {
-		_ = os.Remove(path)
-		Warnln("Write file Failed", err)
-		return require.Response("451 Abort the operation." + err.Error())
+	var fact = "Modify"
+	if command == "MFCT" {
+		fact = "Create"
+		err = driver.SetCreateTime(path, value)
+	} else {
+		err = driver.SetModTime(path, value)
+	}
+	if err == errFileCreateTime {
+		return require.Reply(CodeParameterNotImplemented, "Creation time can't be set on this filesystem")
+	} else if err != nil {
+		Warnln(err)
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
 	}
-	require.DataClose()
 
-	Debugln("Receive File " + path + " from " + require.GetUserName())
-	return require.Response(
-		"226 Close the data connection, the requested file operation is successful\r\n")
+	return require.Reply(CodeFileStatus, fact+"="+args[0]+"; "+args[1])
+}
+
+/* the facts MFF can change, MFCT adds "create" where it's supported */
+var mffFacts = []string{"modify"}
+
+// commandMff sets the facts of "fact=value;...; path". Nothing is changed
+// unless every fact is known and well formed.
+func commandMff(info []byte, driver FileDriver, require FileRequire) error {
+	var args = strings.SplitN(string(info), " ", 2)
+	if len(args) != 2 || !strings.HasSuffix(args[0], ";") {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input facts and file name")
+	}
+
+	var facts = make(map[string]time.Time)
+	for _, fact := range strings.Split(strings.TrimSuffix(args[0], ";"), ";") {
+		var pair = strings.SplitN(fact, "=", 2)
+		if len(pair) != 2 {
+			return require.Replyf(CodeParameterError, "Parameter syntax error.Bad fact %s", fact)
+		}
+
+		var name = strings.ToLower(pair[0])
+		var known = false
+		for _, value := range mffFacts {
+			known = known || value == name
+		}
+		if !known {
+			return require.Replyf(CodeParameterNotImplemented, "Fact %s can't be modified", pair[0])
+		}
+
+		var value, err = parseTimeVal(pair[1])
+		if err != nil {
+			return require.Replyf(CodeParameterError, "Parameter syntax error.%s", err.Error())
+		}
+		facts[name] = value
+	}
+
+	var path, err = fileTimeCheck(args[1], require)
+	if path == "" {
+		return err
+	}
+
+	if value, ok := facts["create"]; ok {
+		err = driver.SetCreateTime(path, value)
+	}
+	if value, ok := facts["modify"]; ok && err == nil {
+		err = driver.SetModTime(path, value)
+	}
+	if err == errFileCreateTime {
+		return require.Reply(CodeParameterNotImplemented, "Creation time can't be set on this filesystem")
+	} else if err != nil {
+		Warnln(err)
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	return require.Reply(CodeFileStatus, args[0]+" "+args[1])
+}
+
+func commandStou(info []byte, driver FileDriver, require FileRequire) error {
+	if !require.CheckAuth(PUT) {
+		Debugln(require.GetUserName() + " Has No Permisson To Put File.")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	/* the client may suggest a name, the server picks the unique one */
+	var name = string(info)
+	if name == "" {
+		name = "ftp.file"
+	}
+
+	var base = realPath(name, require)
+	if base == require.GetRootDir()+"/" {
+		return require.Reply(CodeFileNameNotAllowed, "File name not allowed")
+	}
+
+	/* don't reserve a name for an upload that can't happen */
+	if !require.HasDataConn() {
+		return require.Reply(CodeCantOpenDataConn, "Use PORT or PASV first")
+	}
+
+	unique, err := driver.Uniquefile(base)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	/* report the name relative to where the client put it */
+	name = path.Join(path.Dir(path.Clean(name)), path.Base(unique))
+
+	/* RFC 1123 4.1.2.9 */
+	return runTransferReply(require, "STOU "+name, "FILE: "+name,
+		fmt.Sprintf(require.Translate("Transfer complete (unique file name:%s)"), name),
+		func(ctx context.Context) error {
+			if err := driver.Recvfile(unique, 0, contextReader{ctx, require}); err != nil {
+				if !require.CheckAuth(RECOVER) {
+					_ = os.Remove(unique)
+				}
+				Warnln("Write file Failed", err)
+				return err
+			}
+
+			Debugln("Receive File " + unique + " from " + require.GetUserName())
+			return nil
+		}, func() {
+			/* the data connection never opened, free the reserved name */
+			if err := os.Remove(unique); err != nil {
+				Warnln(err)
+			}
+		})
+}
+
+func commandAppe(info []byte, driver FileDriver, require FileRequire) error {
+	if len(info) == 0 {
+		return require.Reply(CodeParameterError,
+			"Parameter syntax error.Please input file name")
+	}
+
+	if !require.CheckAuth(APPEND) {
+		Debugln(require.GetUserName() + " Has No Permisson To Append File.")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	var path = realPath(string(info), require)
+
+	err := driver.FileIsExist(path)
+	/* appending to a missing file creates it, which is a put */
+	if err == errFileNonExist {
+		if !require.CheckAuth(PUT) {
+			Debugln(require.GetUserName() + " Has No Permisson To Put File.")
+			return require.Reply(CodeNotLoggedIn, "Permission denied")
+		}
+	} else if err == errFileUnkSystem {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	} else if err == errFileSameNameDir {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The same dictionary already exists")
+	}
+
+	var msg = fmt.Sprintf(require.Translate(
+		"Opening %s mode data connection for %s"), transferType(driver), string(info))
+
+	return runTransfer(require, "APPE "+string(info), msg,
+		func(ctx context.Context) error {
+			if err := driver.Appendfile(path, contextReader{ctx, require}); err != nil {
+				Warnln("Append file Failed", err)
+				return err
+			}
+
+			Debugln("Append File " + path + " from " + require.GetUserName())
+			return nil
+		})
 }
 
 func commandDele(info []byte, driver FileDriver, require FileRequire) error {
 	if len(info) == 0 {
-		return require.Response("501 Parameter syntax error.Please input file name\r\n")
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input file name")
 	}
 
 	if !require.CheckAuth(DELETE) {
 		Debugln(require.GetUserName() + " Has No Permisson To Delete File.")
-		return require.Response("530 Parameter denied\r\n")
+		return require.Reply(CodeNotLoggedIn, "Parameter denied")
 	}
 
-	var path string
-	if info[0] == '/' {
-		path = require.GetRootDir() + string(info)
-	} else {
-		path = require.GetCurDir() + string(info)
-	}
+	var path = realPath(string(info), require)
 
 	err := driver.FileIsExist(path)
 
@@ -239,18 +790,75 @@ func commandDele(info []byte, driver FileDriver, require FileRequire) error {
 		/* delete the file*/
 		if err := os.Remove(path); err != nil {
 			Warnln("Delete file Failed", err)
-			return require.Response(
-				"451 Abort the operation of the request,there are local errors\r\n")
+			return require.Reply(CodeLocalError,
+				"Abort the operation of the request,there are local errors")
 		} else {
 			Debugln("Delete File " + path + " from " + require.GetUserName())
-			return require.Response(
-				"250 Requested File Operation Completed\r\n")
+			return require.Reply(CodeFileActionOK,
+				"Requested File Operation Completed")
 		}
 	} else {
-		return require.Response(
-			"501 Parameter syntax error.Please input correctly file name\r\n")
+		return require.Reply(CodeParameterError,
+			"Parameter syntax error.Please input correctly file name")
+	}
+
+}
+
+func commandRnfr(info []byte, driver FileDriver, require FileRequire) error {
+	if len(info) == 0 {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input file name")
+	}
+
+	if !require.CheckAuth(RENAME) {
+		Debugln(require.GetUserName() + " Has No Permisson To Rename File.")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	var path = realPath(string(info), require)
+	if path == require.GetRootDir()+"/" {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The root dictionary can't be renamed")
+	}
+
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file or dictionary is not exist")
+	} else if err != nil {
+		Warnln(err)
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	driver.SetRenameFrom(path)
+	return require.Reply(CodeFileActionPending, "File exists, ready for destination name")
+}
+
+func commandRnto(info []byte, driver FileDriver, require FileRequire) error {
+	/* RNTO is only accepted while renaming, RNFR was sent */
+	var from = driver.GetRenameFrom()
+
+	if len(info) == 0 {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input file name")
+	}
+
+	var path = realPath(string(info), require)
+	if _, err := os.Lstat(path); err == nil {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The target already exists")
+	} else if !os.IsNotExist(err) {
+		Warnln(err)
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	if err := os.Rename(from, path); err != nil {
+		Warnln("Rename file Failed", err)
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
 	}
 
+	Debugln("Rename " + from + " to " + path + " from " + require.GetUserName())
+	return require.Reply(CodeFileActionOK, "Requested File Operation Completed")
 }
 
 func FileProc(command string, info []byte, ftp *Ftp) error {
@@ -260,13 +868,48 @@ func FileProc(command string, info []byte, ftp *Ftp) error {
 		return commandRetr(info, ftp, ftp)
 	} else if command == "DELE" {
 		return commandDele(info, ftp, ftp)
+	} else if command == "STOU" {
+		return commandStou(info, ftp, ftp)
+	} else if command == "APPE" {
+		return commandAppe(info, ftp, ftp)
+	} else if command == "RNFR" {
+		return commandRnfr(info, ftp, ftp)
+	} else if command == "RNTO" {
+		return commandRnto(info, ftp, ftp)
+	} else if command == "SIZE" {
+		return commandSize(info, ftp, ftp)
+	} else if command == "MDTM" {
+		return commandMdtm(info, ftp, ftp)
+	} else if command == "MFMT" || command == "MFCT" {
+		return commandMfxt(command, info, ftp, ftp)
+	} else if command == "MFF" {
+		return commandMff(info, ftp, ftp)
+	} else if command == "TYPE" {
+		return commandType(info, ftp, ftp)
+	} else if command == "REST" {
+		return commandRest(info, ftp, ftp)
 	}
 	Fataln(command)
 	return nil
 }
 
 func init() {
-	register("STOR", FileProc)
-	register("RETR", FileProc)
-	register("DELE", FileProc)
+	register("STOR", stateAuthenticated, FileProc)
+	register("RETR", stateAuthenticated, FileProc)
+	register("DELE", stateAuthenticated, FileProc)
+	register("REST", stateAuthenticated, FileProc)
+	register("TYPE", stateAuthenticated, FileProc)
+	register("APPE", stateAuthenticated, FileProc)
+	register("STOU", stateAuthenticated, FileProc)
+	register("RNFR", stateAuthenticated, FileProc)
+	register("RNTO", stateRenaming, FileProc)
+	register("SIZE", stateAuthenticated, FileProc)
+	register("MDTM", stateAuthenticated, FileProc)
+	register("MFMT", stateAuthenticated, FileProc)
+	register("MFF", stateAuthenticated, FileProc)
+
+	registerFeat("REST", func(*Ftp) string { return "REST STREAM" })
+	registerFeat("MFF", func(*Ftp) string {
+		return "MFF " + strings.Join(mffFacts, ";") + ";"
+	})
 }
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package ftpserver
+
+import "os"
+
+func fileUnique(f os.FileInfo, path string) string {
+	return fileUniqueByPath(path)
+}
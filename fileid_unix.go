@@ -0,0 +1,17 @@
+//go:build unix
+
+package ftpserver
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+/* device and inode identify a file across renames */
+func fileUnique(f os.FileInfo, path string) string {
+	if stat, ok := f.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%xU%x", uint64(stat.Dev), uint64(stat.Ino))
+	}
+	return fileUniqueByPath(path)
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package ftpserver
+
+import "time"
+
+/* unix filesystems keep no settable creation time, MFCT isn't offered */
+func setCreateTime(path string, createTime time.Time) error {
+	return errFileCreateTime
+}
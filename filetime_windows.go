@@ -0,0 +1,32 @@
+//go:build windows
+
+package ftpserver
+
+import (
+	"syscall"
+	"time"
+)
+
+func setCreateTime(path string, createTime time.Time) error {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+
+	/* backup semantics lets the handle open a dictionary too */
+	handle, err := syscall.CreateFile(name, syscall.FILE_WRITE_ATTRIBUTES,
+		syscall.FILE_SHARE_READ|syscall.FILE_SHARE_WRITE, nil,
+		syscall.OPEN_EXISTING, syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(handle)
+
+	var ctime = syscall.NsecToFiletime(createTime.UnixNano())
+	return syscall.SetFileTime(handle, &ctime, nil, nil)
+}
+
+func init() {
+	register("MFCT", stateAuthenticated, FileProc)
+	mffFacts = append(mffFacts, "create")
+}
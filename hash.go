@@ -0,0 +1,198 @@
+package ftpserver
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"strconv"
+	"strings"
+)
+
+const defaultHashAlgo = "SHA-256"
+
+var errBadRange = errors.New("The byte range is malformed.")
+
+/* draft-bryan-ftpext-hash algorithm names, in FEAT order */
+var hashAlgos = []string{"CRC32", "MD5", "SHA-1", "SHA-256", "SHA-512"}
+
+var hashFuncs = map[string]func() hash.Hash{
+	"CRC32":   func() hash.Hash { return crc32.NewIEEE() },
+	"MD5":     md5.New,
+	"SHA-1":   sha1.New,
+	"SHA-256": sha256.New,
+	"SHA-512": sha512.New,
+}
+
+/* the legacy commands each have a fixed algorithm */
+var hashCommands = map[string]string{
+	"XCRC":    "CRC32",
+	"XMD5":    "MD5",
+	"XSHA1":   "SHA-1",
+	"XSHA256": "SHA-256",
+}
+
+/* hash the byte range [start, end) of path, end < 0 is the end of file */
+func fileHash(path string, algo string, start int64, end int64,
+	driver FileDriver) (string, error) {
+
+	var length int64 = -1
+	if end >= 0 {
+		length = end - start
+	}
+
+	var h = hashFuncs[algo]()
+	if err := driver.Hashfile(path, start, length, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+/* HASH answers "213 <algo> <start>-<end> <hash> <path>" for the whole file */
+func commandHash(info []byte, driver FileDriver, require FileRequire) error {
+	var path, err = fileStatCheck(info, driver, require)
+	if path == "" {
+		return err
+	}
+
+	size, err := driver.GetFileSize(path)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	var algo = driver.GetHashAlgo()
+	sum, err := fileHash(path, algo, 0, -1, driver)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	return require.Reply(CodeFileStatus, algo+" 0-"+strconv.FormatInt(size, 10)+
+		" "+sum+" "+string(info))
+}
+
+// hashArgument splits `"name" [start [end]]`. The quotes are optional, an
+// unquoted name keeps its spaces unless the last words are numbers.
+func hashArgument(info string) (string, int64, int64, error) {
+	var name, rest = info, ""
+	if strings.HasPrefix(info, "\"") {
+		var end = strings.Index(info[1:], "\"")
+		if end < 0 {
+			return "", 0, 0, errBadRange
+		}
+		name, rest = info[1:end+1], strings.TrimSpace(info[end+2:])
+	} else {
+		var words = strings.Split(info, " ")
+		var count = 0
+		for count < 2 && count < len(words)-1 {
+			if _, err := strconv.ParseInt(words[len(words)-1-count], 10, 64); err != nil {
+				break
+			}
+			count++
+		}
+		name = strings.Join(words[:len(words)-count], " ")
+		rest = strings.Join(words[len(words)-count:], " ")
+	}
+
+	var start, end int64 = 0, -1
+	var err error
+	var bounds = strings.Fields(rest)
+	if len(bounds) > 2 {
+		return "", 0, 0, errBadRange
+	}
+	if len(bounds) > 0 {
+		if start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil || start < 0 {
+			return "", 0, 0, errBadRange
+		}
+	}
+	if len(bounds) > 1 {
+		if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || end < start {
+			return "", 0, 0, errBadRange
+		}
+	}
+	return name, start, end, nil
+}
+
+/* XCRC, XMD5, XSHA1 and XSHA256 answer "250 <hash>" */
+func commandXhash(command string, info []byte, driver FileDriver,
+	require FileRequire) error {
+
+	var name, start, end, err = hashArgument(string(info))
+	if err != nil {
+		return require.Replyf(CodeParameterError, "Parameter syntax error.%s", err.Error())
+	}
+
+	path, err := fileStatCheck([]byte(name), driver, require)
+	if path == "" {
+		return err
+	}
+
+	size, err := driver.GetFileSize(path)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+	if start > size {
+		return require.Reply(CodeActionNotTaken, "Range start beyond end of file")
+	}
+
+	sum, err := fileHash(path, hashCommands[command], start, end, driver)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+	return require.Reply(CodeFileActionOK, sum)
+}
+
+/* OPTS HASH shows the selected algorithm, OPTS HASH <algo> changes it */
+func commandOptsHash(info []byte, driver FileDriver, require FileRequire) error {
+	var algo = strings.ToUpper(string(info))
+	if algo == "" {
+		return require.Reply(CodeOK, driver.GetHashAlgo())
+	}
+
+	if _, ok := hashFuncs[algo]; !ok {
+		return require.Reply(CodeParameterError, "Unknown algorithm, current selection not changed")
+	}
+	driver.SetHashAlgo(algo)
+	return require.Reply(CodeOK, algo)
+}
+
+/* "HASH CRC32;MD5;SHA-1;SHA-256*;SHA-512" with the selection marked */
+func featHash(ftp *Ftp) string {
+	var feat []string
+	for _, algo := range hashAlgos {
+		if algo == ftp.GetHashAlgo() {
+			algo += "*"
+		}
+		feat = append(feat, algo)
+	}
+	return "HASH " + strings.Join(feat, ";")
+}
+
+func HashProc(command string, info []byte, ftp *Ftp) error {
+	if command == "HASH" {
+		return commandHash(info, ftp, ftp)
+	} else if command == "OPTS HASH" {
+		return commandOptsHash(info, ftp, ftp)
+	} else if _, ok := hashCommands[command]; ok {
+		return commandXhash(command, info, ftp, ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("HASH", stateAuthenticated, HashProc)
+	for command := range hashCommands {
+		register(command, stateAuthenticated, HashProc)
+	}
+	registerOpts("HASH", HashProc)
+
+	registerFeat("HASH", featHash)
+}
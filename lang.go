@@ -0,0 +1,153 @@
+package ftpserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+/* the language of the texts in the code, they are the catalog keys */
+const defaultLang = "EN"
+
+// catalogs holds the RFC 2640 message catalogs by language tag. A catalog
+// maps the English reply text, for Replyf its format, to the translation.
+var catalogs = make(map[string]map[string]string)
+
+var errLangTag = errors.New("bad language tag")
+
+/* RFC 5646 in short, a primary tag and subtags of letters and digits */
+var langTag = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
+
+type LangRequire interface {
+	ReplyRequire
+	SetLang(string)
+	GetLang() string
+}
+
+// loadCatalogs reads the catalogs in dir, one "<tag>.json" file each. An
+// empty dir leaves English only.
+func loadCatalogs(dir string) error {
+	catalogs = make(map[string]map[string]string)
+	if dir == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		var tag = strings.TrimSuffix(filepath.Base(file), ".json")
+		if !langTag.MatchString(tag) || strings.EqualFold(tag, defaultLang) {
+			return errors.New(file + ": " + errLangTag.Error())
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return errors.New(file + ": " + err.Error())
+		}
+		catalogs[tag] = catalog
+	}
+	return nil
+}
+
+/* the available languages, English first */
+func languages() []string {
+	var tags []string
+	for tag := range catalogs {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return append([]string{defaultLang}, tags...)
+}
+
+// findLang returns the available language for tag. Without an exact
+// match a language of the same primary tag is taken, "zh" finds "zh-CN"
+// and "en-US" finds English.
+func findLang(tag string) (string, bool) {
+	var primary = strings.SplitN(tag, "-", 2)[0]
+	var found string
+	for _, lang := range languages() {
+		if strings.EqualFold(lang, tag) {
+			return lang, true
+		}
+		if found == "" && strings.EqualFold(strings.SplitN(lang, "-", 2)[0], primary) {
+			found = lang
+		}
+	}
+	return found, found != ""
+}
+
+/* the text of key in lang, the key itself when there is no translation */
+func translate(lang, key string) string {
+	if text, ok := catalogs[lang][key]; ok && text != "" {
+		return text
+	}
+	return key
+}
+
+func (ctrl *Controller) SetLang(lang string) {
+	ctrl.lang = lang
+}
+
+func (ctrl *Controller) GetLang() string {
+	return ctrl.lang
+}
+
+func (ctrl *Controller) Translate(key string) string {
+	return translate(ctrl.lang, key)
+}
+
+func commandLang(info []byte, require LangRequire) error {
+	/* no argument goes back to the default language */
+	if len(info) == 0 {
+		require.SetLang(defaultLang)
+		return require.Reply(CodeOK, "Language set to default")
+	}
+
+	var tag = string(info)
+	if !langTag.MatchString(tag) {
+		return require.Replyf(CodeParameterError, "Parameter syntax error.%s", errLangTag.Error())
+	}
+
+	lang, ok := findLang(tag)
+	if !ok {
+		return require.Replyf(CodeParameterNotImplemented, "Language %s not supported", tag)
+	}
+
+	require.SetLang(lang)
+	return require.Replyf(CodeOK, "Language set to %s", lang)
+}
+
+/* "LANG EN*;zh-CN", the language of the session marked */
+func featLang(ftp *Ftp) string {
+	var tags = languages()
+	for i, tag := range tags {
+		if tag == ftp.GetLang() {
+			tags[i] += "*"
+		}
+	}
+	return "LANG " + strings.Join(tags, ";")
+}
+
+func LangProc(command string, info []byte, ftp *Ftp) error {
+	if command == "LANG" {
+		return commandLang(info, ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("LANG", stateIdle, LangProc)
+	registerFeat("LANG", featLang)
+}
@@ -0,0 +1,112 @@
+package ftpserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+var ErrLineTooLong = errors.New("Error:command line is too long.")
+
+/* RFC 854 Telnet commands clients put on the control connection */
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// ReadCommand reads the next command line without its CRLF. A line longer
+// than max bytes is skipped up to its end and ErrLineTooLong returned, the
+// connection can go on with the next line.
+func ReadCommand(reader *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	var tooLong = false
+
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			tooLong = len(strings.TrimRight(string(line), "\r\n")) > max
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err == io.EOF && len(line) > 0 && !tooLong {
+			/* the last line may come without its end */
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		break
+	}
+
+	if tooLong {
+		return nil, ErrLineTooLong
+	}
+	return []byte(strings.TrimRight(string(line), "\r\n")), nil
+}
+
+// stripTelnet drops the Telnet commands from a command line, "IAC IP IAC
+// DM" in front of ABOR for one. An escaped "IAC IAC" is a literal 255.
+func stripTelnet(line []byte) []byte {
+	var out = make([]byte, 0, len(line))
+
+	for i := 0; i < len(line); i++ {
+		if line[i] != telnetIAC {
+			out = append(out, line[i])
+			continue
+		}
+
+		if i+1 >= len(line) {
+			break
+		}
+		/* a lone IAC, as left when the urgent DM after "IAC IP IAC"
+		was dropped, takes no byte with it */
+		if line[i+1] < telnetSE {
+			continue
+		}
+		i++
+		switch {
+		case line[i] == telnetIAC:
+			out = append(out, telnetIAC)
+		case line[i] >= telnetWILL && line[i] <= telnetDONT:
+			/* option negotiation carries the option byte */
+			i++
+		case line[i] == telnetSB:
+			/* subnegotiation runs up to IAC SE */
+			for i+1 < len(line) && !(line[i] == telnetIAC && line[i+1] == telnetSE) {
+				i++
+			}
+			i++
+		}
+	}
+	return out
+}
+
+/* split at the first space, the arguments may contain spaces */
+func decode(msg []byte) (string, []byte) {
+	var cmd = string(msg)
+	var info []byte
+
+	for i, r := range msg {
+		if r == ' ' {
+			cmd = string(msg[:i])
+			if i+1 < len(msg) {
+				info = msg[i+1:]
+			}
+			break
+		}
+	}
+
+	return cmd, info
+}
+
+// ParseCommand turns a command line into the upper-case verb and its
+// arguments, with the Telnet commands removed.
+func ParseCommand(line []byte) (string, []byte) {
+	var command, info = decode(stripTelnet(line))
+	return strings.ToUpper(command), info
+}
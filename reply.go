@@ -0,0 +1,151 @@
+package ftpserver
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ReplyCode int
+
+/* RFC 959 reply codes, and those of the extensions the server speaks */
+const (
+	CodeRestartMarker       ReplyCode = 110
+	CodeServiceReadySoon    ReplyCode = 120
+	CodeDataConnAlreadyOpen ReplyCode = 125
+	CodeFileStatusOK        ReplyCode = 150
+
+	CodeOK                      ReplyCode = 200
+	CodeSuperfluous             ReplyCode = 202
+	CodeSystemStatus            ReplyCode = 211
+	CodeDirectoryStatus         ReplyCode = 212
+	CodeFileStatus              ReplyCode = 213
+	CodeHelpMessage             ReplyCode = 214
+	CodeSystemType              ReplyCode = 215
+	CodeServiceReady            ReplyCode = 220
+	CodeServiceClosing          ReplyCode = 221
+	CodeDataConnOpen            ReplyCode = 225
+	CodeClosingDataConn         ReplyCode = 226
+	CodeEnteringPassive         ReplyCode = 227
+	CodeEnteringExtendedPassive ReplyCode = 229 // RFC 2428
+	CodeUserLoggedIn            ReplyCode = 230
+	CodeSecurityExchangeOK      ReplyCode = 234 // RFC 2228
+	CodeFileActionOK            ReplyCode = 250
+	CodePathCreated             ReplyCode = 257
+
+	CodeUserNameOK        ReplyCode = 331
+	CodeNeedAccount       ReplyCode = 332
+	CodeFileActionPending ReplyCode = 350
+
+	CodeServiceNotAvailable     ReplyCode = 421
+	CodeCantOpenDataConn        ReplyCode = 425
+	CodeTransferAborted         ReplyCode = 426
+	CodeNeedSecurityResource    ReplyCode = 431 // RFC 2228
+	CodeFileActionNotTaken      ReplyCode = 450
+	CodeLocalError              ReplyCode = 451
+	CodeInsufficientStorage     ReplyCode = 452
+	CodeSyntaxError             ReplyCode = 500
+	CodeParameterError          ReplyCode = 501
+	CodeNotImplemented          ReplyCode = 502
+	CodeBadSequence             ReplyCode = 503
+	CodeParameterNotImplemented ReplyCode = 504
+	CodeProtocolNotSupported    ReplyCode = 522 // RFC 2428
+	CodeNotLoggedIn             ReplyCode = 530
+	CodeNeedAccountForStoring   ReplyCode = 532
+	CodeProtectionNotSupported  ReplyCode = 536 // RFC 2228
+	CodeFileUnavailable         ReplyCode = 550
+	CodePageTypeUnknown         ReplyCode = 551
+	CodeExceededStorage         ReplyCode = 552
+	CodeFileNameNotAllowed      ReplyCode = 553
+	CodeActionNotTaken          ReplyCode = 554 // RFC 3659, a bad REST offset
+)
+
+type ReplyRequire interface {
+	Reply(ReplyCode, string) error
+	Replyf(ReplyCode, string, ...interface{}) error
+	ReplyMulti(*MultiReply, string) error
+	/* the text of a reply key in the session language */
+	Translate(string) string
+	/* a reply text already translated, sent as it is */
+	reply(ReplyCode, string) error
+}
+
+// MultiReply builds an RFC 959 multi-line reply, "211-" with the first
+// line, the added lines indented by a space so none can pass for the
+// last, then "211 " with the last line.
+type MultiReply struct {
+	code  ReplyCode
+	first string
+	/* with arguments the first line is a format */
+	args  []interface{}
+	lines []string
+}
+
+// NewMultiReply starts a reply with the first line first. Like the format
+// of Replyf, first is the catalog key and the arguments v are data.
+func NewMultiReply(code ReplyCode, first string, v ...interface{}) *MultiReply {
+	return &MultiReply{code: code, first: first, args: v}
+}
+
+/* a text of several lines adds each of them */
+func (reply *MultiReply) Line(text string) *MultiReply {
+	reply.lines = append(reply.lines, replyLines(text)...)
+	return reply
+}
+
+func (reply *MultiReply) Linef(format string, v ...interface{}) *MultiReply {
+	return reply.Line(fmt.Sprintf(format, v...))
+}
+
+func (reply *MultiReply) Format(last string) string {
+	var first = replyLines(reply.first)
+	if len(reply.args) != 0 {
+		first = replyLines(fmt.Sprintf(reply.first, reply.args...))
+	}
+	var msg = fmt.Sprintf("%d-%s\r\n", reply.code, first[0])
+	for _, line := range append(first[1:], reply.lines...) {
+		msg += " " + line + "\r\n"
+	}
+
+	/* the last line closes the reply, the rest of a long text goes before */
+	var tail = replyLines(last)
+	for _, line := range tail[:len(tail)-1] {
+		msg += " " + line + "\r\n"
+	}
+	return msg + fmt.Sprintf("%d %s\r\n", reply.code, tail[len(tail)-1])
+}
+
+/* the lines of a reply text, without their line ends */
+func replyLines(text string) []string {
+	return strings.Split(strings.ReplaceAll(strings.TrimRight(text, "\r\n"), "\r", ""), "\n")
+}
+
+// Reply sends "code msg" in the session language. A msg of several lines
+// is sent as a multi-line reply, so a reply is always well-formed.
+func (ctrl *Controller) Reply(code ReplyCode, msg string) error {
+	return ctrl.reply(code, ctrl.Translate(msg))
+}
+
+func (ctrl *Controller) reply(code ReplyCode, msg string) error {
+	var lines = replyLines(msg)
+	if len(lines) == 1 {
+		return ctrl.Response(fmt.Sprintf("%d %s\r\n", code, lines[0]))
+	}
+
+	var reply = NewMultiReply(code, lines[0])
+	for _, line := range lines[1 : len(lines)-1] {
+		reply.Line(line)
+	}
+	return ctrl.Response(reply.Format(lines[len(lines)-1]))
+}
+
+/* the format is the catalog key, the arguments are never translated */
+func (ctrl *Controller) Replyf(code ReplyCode, format string, v ...interface{}) error {
+	return ctrl.reply(code, fmt.Sprintf(ctrl.Translate(format), v...))
+}
+
+/* the first and last line are translated, the added lines are data */
+func (ctrl *Controller) ReplyMulti(reply *MultiReply, last string) error {
+	var translated = *reply
+	translated.first = ctrl.Translate(reply.first)
+	return ctrl.Response(translated.Format(ctrl.Translate(last)))
+}
@@ -0,0 +1,106 @@
+package ftpserver
+
+import (
+	"crypto/tls"
+	"strconv"
+	"strings"
+)
+
+type SecureDriver interface {
+	/* RFC 4217 explicit FTPS. Upgrade the control connection
+	and keep the negotiated protection state. */
+	UpgradeTLS(*tls.Config) error
+	IsSecure() bool
+	SetPbsz(bool)
+	HasPbsz() bool
+}
+
+type SecureRequire interface {
+	ReplyRequire
+	SetProtection(*tls.Config)
+}
+
+func commandAuth(info []byte, driver SecureDriver, require SecureRequire) error {
+	var mechanism = strings.ToUpper(string(info))
+	if mechanism != "TLS" && mechanism != "TLS-C" && mechanism != "SSL" {
+		return require.Reply(CodeParameterNotImplemented, "Security mechanism not understood")
+	}
+
+	if Conf.Ftp_tls == nil {
+		return require.Reply(CodeNeedSecurityResource, "TLS is not configured on this server")
+	}
+
+	if driver.IsSecure() {
+		return require.Reply(CodeBadSequence, "The control connection is already secure")
+	}
+
+	if err := require.Replyf(CodeSecurityExchangeOK, "AUTH %s OK", mechanism); err != nil {
+		return err
+	}
+
+	/* a failed handshake leaves the connection unusable, drop it */
+	return driver.UpgradeTLS(Conf.Ftp_tls)
+}
+
+func commandPbsz(info []byte, driver SecureDriver, require SecureRequire) error {
+	if !driver.IsSecure() {
+		return require.Reply(CodeBadSequence, "PBSZ is only allowed after AUTH TLS")
+	}
+
+	if _, err := strconv.ParseUint(string(info), 10, 32); err != nil {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Can't idenfy buffer size")
+	}
+
+	/* TLS is a stream protocol, the buffer size is always 0 */
+	driver.SetPbsz(true)
+	return require.Reply(CodeOK, "PBSZ=0")
+}
+
+func commandProt(info []byte, driver SecureDriver, require SecureRequire) error {
+	if !driver.HasPbsz() {
+		return require.Reply(CodeBadSequence, "PROT is only allowed after PBSZ")
+	}
+
+	switch strings.ToUpper(string(info)) {
+	case "C":
+		require.SetProtection(nil)
+		return require.Reply(CodeOK, "Protection level set to Clear")
+	case "P":
+		require.SetProtection(Conf.Ftp_tls)
+		return require.Reply(CodeOK, "Protection level set to Private")
+	case "S", "E":
+		return require.Reply(CodeProtectionNotSupported, "Requested PROT level not supported")
+	}
+	return require.Reply(CodeParameterNotImplemented, "Protection level not understood")
+}
+
+func SecureProc(command string, info []byte, ftp *Ftp) error {
+	if command == "AUTH" {
+		return commandAuth(info, ftp, ftp)
+	} else if command == "PBSZ" {
+		return commandPbsz(info, ftp, ftp)
+	} else if command == "PROT" {
+		return commandProt(info, ftp, ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("AUTH", stateIdle, SecureProc)
+	register("PBSZ", stateIdle, SecureProc)
+	register("PROT", stateIdle, SecureProc)
+
+	/* only advertised when a certificate is configured */
+	var featTLS = func(feat string) featFn {
+		return func(*Ftp) string {
+			if Conf.Ftp_tls == nil {
+				return ""
+			}
+			return feat
+		}
+	}
+	registerFeat("AUTH", featTLS("AUTH TLS"))
+	registerFeat("PBSZ", featTLS("PBSZ"))
+	registerFeat("PROT", featTLS("PROT"))
+}
@@ -15,29 +15,37 @@ type Ftp struct {
 	*DataConn
 	*File
 	*Controller
+	*Transfer
 }
 
-func newFtp(conn *net.TCPConn) *Ftp {
+func newFtp(conn net.Conn, auth Authenticator) *Ftp {
 	return &Ftp{
-		User:       NewUser(),
-		Entry:      new(Entry),
+		User:       NewUser(auth),
+		Entry:      NewEntry(),
 		DataConn:   NewDataConn(),
-		File:       new(File),
+		File:       NewFile(),
 		Controller: NewControler(conn),
+		Transfer:   NewTransfer(),
 	}
 }
 
 type cmdFn func(string, []byte, *Ftp) error
 
-var cmdModules = make(map[string]cmdFn)
+type cmdModule struct {
+	fn cmdFn
+	/* the session states the command is allowed in */
+	states sessionState
+}
+
+var cmdModules = make(map[string]cmdModule)
 
 var normalExit = errors.New("Normal Exit.")
 
-func register(command string, fn cmdFn) {
+func register(command string, states sessionState, fn cmdFn) {
 	if _, ok := cmdModules[command]; ok {
 		Fataln("Repeated registration：", command)
 	}
-	cmdModules[command] = fn
+	cmdModules[command] = cmdModule{fn: fn, states: states}
 }
 
 func PerformHandle(ftp *Ftp, command string, info []byte) error {
@@ -46,41 +54,55 @@ func PerformHandle(ftp *Ftp, command string, info []byte) error {
 		return nil
 	}
 
-	if fn, ok := cmdModules[command]; ok {
-		return fn(command, info, ftp)
+	var module, ok = cmdModules[command]
+	if !ok {
+		Debugln("command " + command + " has no implemented")
+		return ftp.Reply(CodeNotImplemented, "Command not implemented")
 	}
+
+	/* the control connection stays responsive during a transfer, only
+	QUIT waits for it, the other commands without stateTransferring
+	are refused below */
 	if command == "QUIT" {
-		return normalExit
+		ftp.WaitTransfer()
 	}
-	if command == "TYPE" {
-		return ftp.Response("220 Binary\r\n")
-	}
-	Debugln("command " + command + " has no implemented")
-	return ftp.Response("502 Command not implemented\r\n")
-}
-
-func decode(msg []byte) (string, []byte) {
 
-	var cmd = string(msg)
-	var info []byte
-
-	for i, r := range msg {
-		if r == ' ' {
-			cmd = string(msg[:i])
-			if i+1 < len(msg) {
-				info = msg[i+1:]
-			}
-		}
+	/* REST and RNFR only apply to the command right after them */
+	if command != "REST" {
+		defer ftp.SetRestart(0)
+	}
+	if command != "RNFR" {
+		defer ftp.SetRenameFrom("")
 	}
 
-	return cmd, info
+	if module.states&ftp.sessionState() == 0 {
+		return refuseCommand(ftp, command, module.states)
+	}
+	return module.fn(command, info, ftp)
 }
 
 func ftpPerform(ftp *Ftp) {
 	var reader = ftp.Reader()
 	for {
-		msg, _, err := reader.ReadLine()
-		if err != nil {
+		if err := ftp.WaitIdle(); err != nil {
+			Warnln(err)
+			break
+		}
+
+		msg, err := ReadCommand(reader, Conf.Ftp_max_line)
+		if err == ErrLineTooLong {
+			if err := ftp.Reply(CodeSyntaxError, "Command line too long"); err != nil {
+				break
+			}
+			continue
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			/* a long transfer keeps the control connection quiet */
+			if ftp.InTransfer() {
+				continue
+			}
+			ftp.Reply(CodeServiceNotAvailable, "Timeout, closing control connection")
+			break
+		} else if err != nil {
 			if err == io.EOF {
 				break
 			}
@@ -88,7 +110,7 @@ func ftpPerform(ftp *Ftp) {
 			break
 		}
 
-		cmd, info := decode(msg)
+		cmd, info := ParseCommand(msg)
 
 		if err := PerformHandle(ftp, cmd, info); err != nil {
 			if err != normalExit {
@@ -97,34 +119,99 @@ func ftpPerform(ftp *Ftp) {
 			break
 		}
 	}
+
+	/* stop the transfer and a pending PASV, then wait for them to end */
+	ftp.ExitTransfer()
+	ftp.DataAbort()
+	ftp.WaitTransfer()
+	ftp.DataClose()
 	ftp.ExitControl()
 }
 
-func Start() {
-
-	var listen, err = net.Listen("tcp4", Conf.Ftp_addr+":"+Conf.Ftp_port)
+func listenCtrl(port string) net.Listener {
+	var addr = net.JoinHostPort(Conf.Ftp_addr, port)
+	var listen, err = net.Listen(Conf.Ftp_network, addr)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	log.Println("tcp4: Listen succeed.", Conf.Ftp_addr+":"+Conf.Ftp_port)
+	log.Println(Conf.Ftp_network+": Listen succeed.", addr)
+	return listen
+}
+
+// Server is an FTP server of the Conf settings. Embedders construct it
+// with their own Authenticator.
+type Server struct {
+	auth Authenticator
+}
+
+/* a nil auth logs in the users of the config file */
+func NewServer(auth Authenticator) *Server {
+	if auth == nil {
+		auth = ConfAuthenticator{}
+	}
+	return &Server{auth: auth}
+}
+
+func (srv *Server) serveCtrl(conn net.Conn, implicit bool) {
+	//Debugln("accept control connection from ", conn.RemoteAddr())
+
+	var ftp = newFtp(conn, srv.auth)
+
+	/* implicit FTPS: TLS from the first byte, data always protected */
+	if implicit {
+		if err := ftp.UpgradeTLS(Conf.Ftp_tls); err != nil {
+			Warnln(err)
+			ftp.ExitControl()
+			return
+		}
+		ftp.SetPbsz(true)
+		ftp.SetProtection(Conf.Ftp_tls)
+	}
+
+	if ftp.Welcome() != nil {
+		ftp.ExitControl()
+		return
+	}
 
+	ftpPerform(ftp)
+}
+
+func (srv *Server) serve(listen net.Listener, implicit bool) error {
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 
-		//Debugln("accept control connection from ", conn.RemoteAddr())
+		go srv.serveCtrl(conn, implicit)
+	}
+}
 
-		var ftp = newFtp(conn.(*net.TCPConn))
-		if ftp.Welcome() != nil {
-			ftp.ExitControl()
-			continue
-		}
+// Serve accepts plain FTP control connections on a listener of the
+// embedder until it fails or is closed.
+func (srv *Server) Serve(listen net.Listener) error {
+	return srv.serve(listen, false)
+}
 
-		go ftpPerform(ftp)
+func (srv *Server) Start() {
+
+	if Conf.Ftp_implicit_port != "" {
+		if Conf.Ftp_tls == nil {
+			log.Fatalln("Error: implicit FTPS needs ftp_tls_cert and ftp_tls_key")
+		}
+		var listen = listenCtrl(Conf.Ftp_implicit_port)
+		go func() {
+			log.Fatalln(srv.serve(listen, true))
+		}()
 	}
+
+	log.Fatalln(srv.serve(listenCtrl(Conf.Ftp_port), false))
+}
+
+/* the server of the config file and its users */
+func Start() {
+	NewServer(nil).Start()
 }
 
 /* some public function */
@@ -0,0 +1,186 @@
+package ftpserver
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SiteRequire interface {
+	ReplyRequire
+	GetUserName() string
+	CheckAuth(uint) bool
+
+	GetCurDir() string
+	GetRootDir() string
+
+	SetUmask(os.FileMode)
+	GetUmask() os.FileMode
+	SetIdle(time.Duration)
+	GetIdle() time.Duration
+}
+
+/* SITE sub-commands, dispatched as "SITE <name>" */
+var siteModules = make(map[string]cmdFn)
+
+// RegisterSite adds the SITE sub-command name. Like the built-in ones, fn
+// gets "SITE <NAME>" with the arguments and checks its own permissions,
+// SITE is only accepted after login.
+func RegisterSite(name string, fn func(string, []byte, *Ftp) error) {
+	name = strings.ToUpper(name)
+	if _, ok := siteModules[name]; ok {
+		Fataln("Repeated registration：", "SITE "+name)
+	}
+	siteModules[name] = fn
+}
+
+func commandSite(info []byte, ftp *Ftp) error {
+	var name, args = decode(info)
+	name = strings.ToUpper(name)
+	if name == "" {
+		return ftp.Reply(CodeParameterError, "Parameter syntax error.Please input SITE command")
+	}
+
+	if fn, ok := siteModules[name]; ok {
+		return fn("SITE "+name, args, ftp)
+	}
+	return ftp.Replyf(CodeParameterNotImplemented, "SITE %s not implemented", name)
+}
+
+/* SITE CHMOD <octal mode> <path>, the special bits are refused */
+func commandSiteChmod(info []byte, require SiteRequire) error {
+	if !require.CheckAuth(CHMOD) {
+		Debugln(require.GetUserName() + " Has No Permisson To Change Mode.")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	var args = strings.SplitN(string(info), " ", 2)
+	if len(args) != 2 || args[1] == "" {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input mode and file name")
+	}
+
+	var mode, err = strconv.ParseUint(args[0], 8, 32)
+	if err != nil || mode > 0777 {
+		return require.Replyf(CodeParameterError, "Parameter syntax error.Bad mode %s", args[0])
+	}
+
+	/* chmod follows links, so neither a link nor one above the
+	path may lead it out of the root */
+	var path = filepath.Clean(realPath(args[1], require))
+	if f, err := os.Lstat(path); os.IsNotExist(err) {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file or dictionary is not exist")
+	} else if err == nil && f.Mode()&os.ModeSymlink != 0 {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The mode of a symbolic link can't be changed")
+	} else if path != filepath.Clean(require.GetRootDir()) && outsideRoot(path, require.GetRootDir()) {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file is outside the root")
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		Warnln(err)
+		return require.Reply(CodeLocalError,
+			"Abort the operation of the request,there are local errors")
+	}
+
+	Debugln(require.GetUserName() + " change mode " + path + " to " + args[0])
+	return require.Reply(CodeOK, "SITE CHMOD command successful")
+}
+
+/* SITE UMASK shows the umask of new files, SITE UMASK <octal> changes it */
+func commandSiteUmask(info []byte, require SiteRequire) error {
+	if !require.CheckAuth(CHMOD) {
+		Debugln(require.GetUserName() + " Has No Permisson To Change Mode.")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	if len(info) == 0 {
+		return require.Replyf(CodeOK, "Current UMASK is %03o",
+			require.GetUmask())
+	}
+
+	var umask, err = strconv.ParseUint(string(info), 8, 32)
+	if err != nil || umask > 0777 {
+		return require.Replyf(CodeParameterError, "Parameter syntax error.Bad umask %s", string(info))
+	}
+
+	require.SetUmask(os.FileMode(umask))
+	return require.Replyf(CodeOK, "UMASK set to %03o", umask)
+}
+
+/* SITE IDLE shows the idle timeout, SITE IDLE <seconds> changes it */
+func commandSiteIdle(info []byte, require SiteRequire) error {
+	if !require.CheckAuth(SETIDLE) {
+		Debugln(require.GetUserName() + " Has No Permisson To Change IDLE.")
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	if len(info) == 0 {
+		return require.Replyf(CodeOK,
+			"Current IDLE time limit is %d seconds; max %d",
+			require.GetIdle()/time.Second, Conf.Ftp_max_idle_timeout)
+	}
+
+	var idle, err = strconv.Atoi(string(info))
+	if err != nil || idle < 1 || idle > Conf.Ftp_max_idle_timeout {
+		return require.Replyf(CodeParameterError,
+			"IDLE time must be between 1 and %d seconds",
+			Conf.Ftp_max_idle_timeout)
+	}
+
+	require.SetIdle(time.Duration(idle) * time.Second)
+	return require.Replyf(CodeOK, "Maximum IDLE time set to %d seconds", idle)
+}
+
+/* SITE RMDIR [-r] <path>, RMD or with -r RMDA */
+func commandSiteRmdir(info []byte, ftp *Ftp) error {
+	if args := string(info); strings.HasPrefix(args, "-r ") {
+		return commandRmda([]byte(strings.TrimLeft(args[3:], " ")), ftp, ftp)
+	}
+	return commandRmd(info, ftp, ftp)
+}
+
+func commandSiteHelp(require SiteRequire) error {
+	var names []string
+	for name := range siteModules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var reply = NewMultiReply(CodeHelpMessage, "The following SITE commands are recognized:")
+	for _, name := range names {
+		reply.Line(name)
+	}
+	return require.ReplyMulti(reply, "Help OK")
+}
+
+func SiteProc(command string, info []byte, ftp *Ftp) error {
+	if command == "SITE" {
+		return commandSite(info, ftp)
+	} else if command == "SITE CHMOD" {
+		return commandSiteChmod(info, ftp)
+	} else if command == "SITE UMASK" {
+		return commandSiteUmask(info, ftp)
+	} else if command == "SITE IDLE" {
+		return commandSiteIdle(info, ftp)
+	} else if command == "SITE RMDIR" {
+		return commandSiteRmdir(info, ftp)
+	} else if command == "SITE HELP" {
+		return commandSiteHelp(ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("SITE", stateAuthenticated, SiteProc)
+
+	RegisterSite("CHMOD", SiteProc)
+	RegisterSite("UMASK", SiteProc)
+	RegisterSite("IDLE", SiteProc)
+	RegisterSite("RMDIR", SiteProc)
+	RegisterSite("HELP", SiteProc)
+}
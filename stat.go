@@ -0,0 +1,121 @@
+package ftpserver
+
+import (
+	"net"
+	"os"
+)
+
+type StatRequire interface {
+	ReplyRequire
+	RemoteAddr() net.Addr
+	IsSecure() bool
+
+	GetLoginState() sessionState
+	GetUserName() string
+
+	GetPwd() string
+	GetRootDir() string
+	GetCurDir() string
+	Getlist(string) ([]byte, error)
+	Getinfo(string) (os.FileInfo, error)
+
+	IsAscii() bool
+	IsCompressed() bool
+	GetCompressLevel() int
+
+	GetDataMode() string
+	GetDataBytes() int64
+	IsProtected() bool
+	GetTransferName() string
+}
+
+func commandStatus(require StatRequire) error {
+	var reply = NewMultiReply(CodeSystemStatus, "FTP server status:")
+	reply.Line("Connected to " + require.RemoteAddr().String())
+
+	if require.GetLoginState() != stateAuthenticated {
+		reply.Line("Not logged in")
+	} else {
+		reply.Line("Logged in as " + require.GetUserName())
+		reply.Line("Current directory " + require.GetPwd())
+	}
+
+	if require.IsAscii() {
+		reply.Line("TYPE: ASCII")
+	} else {
+		reply.Line("TYPE: Binary")
+	}
+
+	if require.IsCompressed() {
+		reply.Linef("MODE: Z, level %d", require.GetCompressLevel())
+	} else {
+		reply.Line("MODE: Stream")
+	}
+
+	if require.IsSecure() {
+		reply.Line("Control connection is protected by TLS")
+	} else {
+		reply.Line("Control connection is plain text")
+	}
+
+	var mode = require.GetDataMode()
+	if mode == "" {
+		reply.Line("No data connection")
+	} else if require.IsProtected() {
+		reply.Line("Data connection: " + mode + ", protected by TLS")
+	} else {
+		reply.Line("Data connection: " + mode + ", plain text")
+	}
+
+	if name := require.GetTransferName(); name != "" {
+		reply.Linef("Transfer in progress: %s, %d bytes",
+			name, require.GetDataBytes())
+	}
+
+	return require.ReplyMulti(reply, "End of status")
+}
+
+/* the listing of LIST, sent over the control connection */
+func commandStatPath(info []byte, require StatRequire) error {
+	if require.GetLoginState() != stateAuthenticated {
+		return require.Reply(CodeNotLoggedIn, "Please login with USER and PASS")
+	}
+
+	var path = realPath(string(info), require)
+
+	var f, err = require.Getinfo(path)
+	if err == errPathNonExist {
+		return require.Reply(CodeFileUnavailable, "The operation that did not execute."+
+			"The file or dictionary is not exist")
+	} else if err != nil {
+		return require.Reply(CodeLocalError, "Has unknown local Error")
+	}
+
+	if !f.IsDir() {
+		var reply = NewMultiReply(CodeFileStatus, "Status of %s:", string(info))
+		return require.ReplyMulti(reply.Line(listLine(f)), "End of status")
+	}
+
+	list, err := require.Getlist(path)
+	if err != nil {
+		return require.Reply(CodeLocalError,
+			"Has unknown local Error.Get dictionary Error")
+	}
+	var reply = NewMultiReply(CodeDirectoryStatus, "Status of %s:", string(info))
+	return require.ReplyMulti(reply.Line(string(list)), "End of status")
+}
+
+func StatProc(command string, info []byte, ftp *Ftp) error {
+	if command == "STAT" {
+		if len(info) == 0 {
+			return commandStatus(ftp)
+		}
+		return commandStatPath(info, ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("STAT", stateAny, StatProc)
+}
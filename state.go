@@ -0,0 +1,64 @@
+package ftpserver
+
+// sessionState is where the session stands, every command is registered
+// with the states that allow it.
+type sessionState uint
+
+const (
+	/* no USER yet, or the last PASS failed */
+	stateConnected sessionState = 1 << iota
+	/* USER was sent, PASS is expected */
+	stateUserGiven
+	stateAuthenticated
+	/* RNFR succeeded, RNTO is expected */
+	stateRenaming
+	/* a data transfer runs in the background */
+	stateTransferring
+)
+
+const (
+	/* neither renaming nor transferring, logged in or not */
+	stateIdle = stateConnected | stateUserGiven | stateAuthenticated
+	stateAny  = stateIdle | stateRenaming | stateTransferring
+)
+
+func (ftp *Ftp) sessionState() sessionState {
+	var state = ftp.GetLoginState()
+	if state != stateAuthenticated {
+		return state
+	}
+
+	if ftp.InTransfer() {
+		return stateTransferring
+	} else if ftp.GetRenameFrom() != "" {
+		return stateRenaming
+	}
+	return stateAuthenticated
+}
+
+/* 530 for what needs a login first, 503 for the rest */
+func refuseCommand(ftp *Ftp, command string, states sessionState) error {
+	if ftp.GetLoginState() != stateAuthenticated &&
+		states&(stateAuthenticated|stateRenaming) != 0 {
+		return ftp.Reply(CodeNotLoggedIn, "Please login with USER and PASS")
+	}
+
+	Debugln("command " + command + " is out of sequence")
+	return ftp.Reply(CodeBadSequence, "Bad sequence of commands")
+}
+
+func SessionProc(command string, info []byte, ftp *Ftp) error {
+	if command == "QUIT" {
+		return normalExit
+	} else if command == "NOOP" {
+		return ftp.Reply(CodeOK, "NOOP ok")
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	/* QUIT waits for a running transfer to finish */
+	register("QUIT", stateIdle|stateRenaming, SessionProc)
+	register("NOOP", stateAny, SessionProc)
+}
@@ -1,8 +1,13 @@
 package test
 
 import (
+	"bufio"
 	. "ftpserver"
+	"io/ioutil"
+	"net"
+	"os"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -43,12 +48,15 @@ func authCheck(t *testing.T, command string, status int) {
 func Test_Get(t *testing.T) {
 	Conf.Users[0].Get = false
 	authCheck(t, "RETR test\r\n", 530)
+	authCheck(t, "SIZE download.bin\r\n", 530)
+	authCheck(t, "MDTM download.bin\r\n", 530)
 	Conf.Users[0].Get = true
 }
 
 func Test_Put(t *testing.T) {
 	Conf.Users[0].Put = false
 	authCheck(t, "STOR test\r\n", 530)
+	authCheck(t, "STOU test\r\n", 530)
 	Conf.Users[0].Put = true
 }
 
@@ -64,6 +72,25 @@ func Test_Recover(t *testing.T) {
 	Conf.Users[0].Recover = true
 }
 
+func Test_Append(t *testing.T) {
+	Conf.Users[0].Append = false
+	authCheck(t, "APPE download.bin\r\n", 530)
+	Conf.Users[0].Append = true
+
+	Conf.Users[0].Put = false
+	authCheck(t, "APPE nonexist.bin\r\n", 530)
+	Conf.Users[0].Put = true
+}
+
+func Test_Rename(t *testing.T) {
+	Conf.Users[0].Rename = false
+	authCheck(t, "RNFR download.bin\r\n", 530)
+	Conf.Users[0].Rename = true
+
+	authCheck(t, "RNFR download.bin\r\n", 350)
+	authCheck(t, "RNTO upload.bin\r\n", 503)
+}
+
 func Test_Mkdr(t *testing.T) {
 	Conf.Users[0].MkDir = false
 	authCheck(t, "MKD testMkdir\r\n", 530)
@@ -80,5 +107,81 @@ func Test_DelDir(t *testing.T) {
 	Conf.Users[0].MkDir = true
 	authCheck(t, "MKD testMkdir\r\n", 257)
 
-	authCheck(t, "RMD testMkdir\r\n", 250)
+	/* each check starts in a new environment without testMkdir */
+	authCheck(t, "RMD testMkdir\r\n", 550)
+}
+
+/* logs in "token" from the loopback only, read-only with its own idle time */
+type tokenAuthenticator struct{}
+
+func (tokenAuthenticator) Authenticate(info *AuthInfo) (*Identity, error) {
+	var addr, ok = info.Remote.(*net.TCPAddr)
+	if info.Name != "token" || info.Pass != "secret" || !ok || !addr.IP.IsLoopback() {
+		return nil, ErrAuthFailed
+	}
+	return &Identity{
+		Name:  "token",
+		Root:  default_test_path,
+		Perms: PermMask(GET, SETIDLE),
+		Idle:  time.Minute,
+	}, nil
+}
+
+func Test_Authenticator(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	listen, err := net.Listen("tcp4", Conf.Ftp_addr+":0")
+	check_err(err, t)
+	defer listen.Close()
+	go NewServer(tokenAuthenticator{}).Serve(listen)
+
+	ctl, err := net.Dial("tcp4", listen.Addr().String())
+	check_err(err, t)
+	defer ctl.Close()
+
+	var ss = &session{t: t, ctl: ctl, reader: bufio.NewReader(ctl)}
+	expect_reply(t, ss.reader, 220)
+
+	/* the users of the config file are not known to this server */
+	ss.send("USER root", 331)
+	ss.send("PASS root", 530)
+	ss.send("USER token", 331)
+	ss.send("PASS wrong", 530)
+
+	ss.send("USER token", 331)
+	ss.send("PASS secret", 230)
+	ss.send("SIZE download.bin", 213)
+	ss.send("STOR upload.bin", 530)
+	if msg := ss.send("SITE IDLE", 200); !strings.Contains(msg, " 60 seconds") {
+		t.Fatal(msg)
+	}
+}
+
+/* a listener of the embedder that isn't TCP, passive mode can't work */
+func Test_ServeUnix(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	dir, err := ioutil.TempDir("", "ftpserver")
+	check_err(err, t)
+	defer os.RemoveAll(dir)
+
+	listen, err := net.Listen("unix", dir+"/ftp.sock")
+	check_err(err, t)
+	defer listen.Close()
+	go NewServer(nil).Serve(listen)
+
+	ctl, err := net.Dial("unix", dir+"/ftp.sock")
+	check_err(err, t)
+	defer ctl.Close()
+
+	var ss = &session{t: t, ctl: ctl, reader: bufio.NewReader(ctl)}
+	expect_reply(t, ss.reader, 220)
+	ss.send("USER root", 331)
+	ss.send("PASS root", 230)
+	ss.send("PASV", 425)
+	ss.send("EPSV", 425)
+	ss.send("EPSV 1", 425)
+	ss.send("NOOP", 200)
 }
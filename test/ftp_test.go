@@ -2,8 +2,14 @@ package test
 
 import (
 	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/md5"
+	"crypto/sha256"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
 	"os"
@@ -92,6 +98,65 @@ func create_control(t *testing.T, user string, pass string) net.Conn {
 	return ctl
 }
 
+func read_reply(t *testing.T, reader *bufio.Reader) string {
+	line, err := reader.ReadString('\n')
+	check_err(err, t)
+	return line
+}
+
+func expect_reply(t *testing.T, reader *bufio.Reader, status int) string {
+	var line = read_reply(t, reader)
+	if getStatus(t, []byte(line)) != status {
+		t.Fatal(line, status)
+	}
+	return line
+}
+
+/* a logged in control connection, replies are read line by line */
+type session struct {
+	t      *testing.T
+	ctl    net.Conn
+	reader *bufio.Reader
+}
+
+func create_session(t *testing.T, user string, pass string) *session {
+	var ss = &session{t: t, ctl: create_control(t, user, pass)}
+	ss.reader = bufio.NewReader(ss.ctl)
+
+	expect_reply(t, ss.reader, 220)
+	expect_reply(t, ss.reader, 331)
+	read_reply(t, ss.reader)
+	return ss
+}
+
+func (ss *session) send(command string, status int) string {
+	_, err := ss.ctl.Write([]byte(command + "\r\n"))
+	check_err(err, ss.t)
+	return expect_reply(ss.t, ss.reader, status)
+}
+
+func (ss *session) pasv() net.Conn {
+	data, err := net.Dial("tcp4", ss.pasvAddr())
+	check_err(err, ss.t)
+	return data
+}
+
+/* the address of the PASV reply, nothing connected to it yet */
+func (ss *session) pasvAddr() string {
+	var pasv = ss.send("PASV", 227)
+
+	var start = strings.Index(pasv, "(")
+	var end = strings.Index(pasv, ")")
+	if end <= start {
+		ss.t.Fatal(pasv)
+	}
+
+	var nums = strings.Split(pasv[start+1:end], ",")
+	var port1, _ = strconv.Atoi(nums[4])
+	var port2, _ = strconv.Atoi(nums[5])
+	return "127.0.0.1:" + strconv.Itoa(port1*256+port2)
+}
+
 func create_pasv_conn(t *testing.T, user string, pass string) (net.Conn, net.Conn) {
 
 	var ctl = create_control(t, user, pass)
@@ -118,6 +183,7 @@ func create_pasv_conn(t *testing.T, user string, pass string) (net.Conn, net.Con
 		if string(msg[:3]) == "227" &&
 			strings.Contains(string(msg), "Passive") {
 			pasv = string(msg)
+			break
 		}
 	}
 
@@ -330,7 +396,1140 @@ func Test_Transfer(t *testing.T) {
 	//upload(t, "root", "root", "1")
 }
 
+func Test_Extended(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+	var send = ss.send
+
+	var list = func(data net.Conn) {
+		ss.send("LIST", 150)
+
+		var buf, _ = ioutil.ReadAll(data)
+		if !strings.Contains(string(buf), "download.bin") {
+			t.Fatal(string(buf))
+		}
+		expect_reply(t, ss.reader, 226)
+	}
+
+	/* EPSV */
+	var epsv = send("EPSV", 229)
+	var start = strings.Index(epsv, "(|||")
+	var end = strings.Index(epsv, "|)")
+	if start < 0 || end <= start {
+		t.Fatal(epsv)
+	}
+
+	data, err := net.Dial("tcp4", "127.0.0.1:"+epsv[start+4:end])
+	check_err(err, t)
+	list(data)
+
+	/* EPRT */
+	send("EPRT |3|127.0.0.1|21|", 522)
+
+	port_lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	check_err(err, t)
+	defer port_lis.Close()
+
+	var port = port_lis.Addr().(*net.TCPAddr).Port
+	send("EPRT |1|127.0.0.1|"+strconv.Itoa(port)+"|", 200)
+
+	data, err = port_lis.Accept()
+	check_err(err, t)
+	list(data)
+
+	/* EPSV ALL */
+	send("EPSV ALL", 200)
+	send("PASV", 503)
+}
+
+func Test_Rest(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	Conf.Users[0].Recover = true
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("REST abc", 501)
+	ss.send("REST 100000000", 350)
+	ss.send("RETR download.bin", 554)
+
+	/* download the tail of the file */
+	var data = ss.pasv()
+	ss.send("REST 1000", 350)
+	ss.send("RETR download.bin", 150)
+
+	tail, err := ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+
+	whole, err := ioutil.ReadFile(default_download_path)
+	check_err(err, t)
+	if string(tail) != string(whole[1000:]) {
+		t.Fatal("the resumed download is not the tail of the file")
+	}
+
+	/* resume the upload of a truncated copy */
+	var path = default_test_path + "/resume.bin"
+	check_err(ioutil.WriteFile(path, whole[:1000], 0600), t)
+
+	data = ss.pasv()
+	ss.send("REST 1000", 350)
+	ss.send("STOR resume.bin", 150)
+	_, err = data.Write(whole[1000:])
+	check_err(err, t)
+	check_err(data.Close(), t)
+	expect_reply(t, ss.reader, 226)
+
+	if !compare(path, default_download_path) {
+		t.Fatal(path, default_download_path, "cmp command is not same!")
+	}
+
+	/* the marker is only valid for the next command */
+	data = ss.pasv()
+	ss.send("REST 100000000", 350)
+	ss.send("PWD", 257)
+	ss.send("RETR download.bin", 150)
+	_, err = ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+
+	Conf.Users[0].Recover = false
+	ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("REST 10", 350)
+	ss.send("STOR resume.bin", 530)
+}
+
+func Test_Appe(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var path = default_test_path + "/append.log"
+	for _, line := range []string{"first\n", "second\n"} {
+		var data = ss.pasv()
+		ss.send("APPE append.log", 150)
+		_, err := data.Write([]byte(line))
+		check_err(err, t)
+		check_err(data.Close(), t)
+		expect_reply(t, ss.reader, 226)
+	}
+
+	content, err := ioutil.ReadFile(path)
+	check_err(err, t)
+	if string(content) != "first\nsecond\n" {
+		t.Fatal(string(content))
+	}
+}
+
+func Test_Rnfr(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("RNFR nonexist.bin", 550)
+	ss.send("RNFR /", 550)
+
+	ss.send("RNFR download.bin", 350)
+	ss.send("RNTO upload.bin", 550)
+
+	/* RNTO must follow RNFR, anything else ends the rename */
+	ss.send("RNFR download.bin", 350)
+	ss.send("PWD", 503)
+	ss.send("RNTO renamed.bin", 503)
+
+	/* "../" stays inside the root */
+	ss.send("RNFR ../../download.bin", 350)
+	ss.send("RNTO renamed.bin", 250)
+	if _, err := os.Stat(default_test_path + "/renamed.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	ss.send("MKD olddir", 257)
+	ss.send("RNFR olddir", 350)
+	ss.send("RNTO /newdir", 250)
+	ss.send("CWD newdir", 250)
+}
+
+func Test_SizeMdtm(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	stat, err := os.Stat(default_download_path)
+	check_err(err, t)
+
+	var size = ss.send("SIZE download.bin", 213)
+	if strings.TrimSpace(size) != "213 "+strconv.FormatInt(stat.Size(), 10) {
+		t.Fatal(size)
+	}
+
+	var mdtm = ss.send("MDTM /download.bin", 213)
+	if strings.TrimSpace(mdtm) != "213 "+stat.ModTime().UTC().Format("20060102150405") {
+		t.Fatal(mdtm)
+	}
+
+	ss.send("SIZE nonexist.bin", 550)
+	ss.send("MDTM nonexist.bin", 550)
+	ss.send("MKD dir", 257)
+	ss.send("SIZE dir", 550)
+}
+
+func Test_Mlsx(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	Conf.Users[0].Delete = false
+	defer func() { Conf.Users[0].Delete = true }()
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("MLST download.bin", 250)
+	var facts = read_reply(t, ss.reader)
+	if !strings.HasPrefix(facts, " type=file;size=2097152;") ||
+		!strings.Contains(facts, ";perm=raf;") ||
+		!strings.Contains(facts, ";unix.mode=0600;") ||
+		!strings.HasSuffix(facts, "; /download.bin\r\n") {
+		t.Fatal(facts)
+	}
+	expect_reply(t, ss.reader, 250)
+
+	ss.send("MLST nonexist.bin", 550)
+	ss.send("MLSD download.bin", 501)
+
+	var data = ss.pasv()
+	ss.send("MLSD", 150)
+	list, err := ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+
+	if !strings.Contains(string(list), "type=file;size=2097152;") ||
+		!strings.Contains(string(list), "; upload.bin\r\n") {
+		t.Fatal(string(list))
+	}
+}
+
+func Test_Nlst(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var nlst = func(arg string) string {
+		var data = ss.pasv()
+		ss.send("NLST "+arg, 150)
+		list, err := ioutil.ReadAll(data)
+		check_err(err, t)
+		expect_reply(t, ss.reader, 226)
+		return string(list)
+	}
+
+	ss.send("MKD sub", 257)
+	check_err(ioutil.WriteFile(default_test_path+"/sub/a.csv", nil, 0600), t)
+	check_err(ioutil.WriteFile(default_test_path+"/sub/b.csv", nil, 0600), t)
+	check_err(ioutil.WriteFile(default_test_path+"/sub/.c.csv", nil, 0600), t)
+
+	if list := nlst("*.bin"); list != "download.bin\r\nupload.bin\r\n" {
+		t.Fatal(list)
+	}
+	if list := nlst("sub/*.csv"); list != "sub/a.csv\r\nsub/b.csv\r\n" {
+		t.Fatal(list)
+	}
+	if list := nlst("sub"); list != "sub/a.csv\r\nsub/b.csv\r\nsub/.c.csv\r\n" &&
+		list != "sub/.c.csv\r\nsub/a.csv\r\nsub/b.csv\r\n" {
+		t.Fatal(list)
+	}
+	if list := nlst("../../../sub/b.csv"); list != "../../../sub/b.csv\r\n" {
+		t.Fatal(list)
+	}
+
+	if list := nlst("-l"); !strings.Contains(list, "download.bin\r\n") {
+		t.Fatal(list)
+	}
+	/* globs are evaluated inside the root */
+	if list := nlst("../../*.bin"); list != "../../download.bin\r\n../../upload.bin\r\n" {
+		t.Fatal(list)
+	}
+
+	ss.send("MKD empty", 257)
+	if list := nlst("empty"); list != "" {
+		t.Fatal(list)
+	}
+	ss.send("CWD empty", 250)
+	if list := nlst(""); list != "" {
+		t.Fatal(list)
+	}
+
+	ss.send("NLST *.txt", 450)
+	ss.send("NLST [", 501)
+}
+
+func Test_FeatOpts(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var feat = func() []string {
+		ss.send("FEAT", 211)
+		var lines []string
+		for {
+			var line = read_reply(t, ss.reader)
+			if strings.HasPrefix(line, "211 ") {
+				return lines
+			}
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+
+	var features = strings.Join(feat(), ",")
+	for _, expect := range []string{"EPSV", "MDTM", "SIZE", "REST STREAM", "UTF8",
+		"MLST type*;size*;modify*;perm*;unique*;unix.mode*;"} {
+		if !strings.Contains(","+features+",", ","+expect+",") {
+			t.Fatal(features, expect)
+		}
+	}
+	if strings.Contains(features, "RETR") || strings.Contains(features, "MLSD") ||
+		strings.Contains(features, "AUTH") {
+		t.Fatal(features)
+	}
+
+	ss.send("OPTS UTF8 ON", 200)
+	ss.send("OPTS NOPE", 501)
+	ss.send("OPTS MLST size;Type;bogus;", 200)
+
+	features = strings.Join(feat(), ",")
+	if !strings.Contains(features, "MLST type*;size*;modify;perm;unique;unix.mode;") {
+		t.Fatal(features)
+	}
+
+	ss.send("MLST download.bin", 250)
+	if facts := read_reply(t, ss.reader); facts != " type=file;size=2097152; /download.bin\r\n" {
+		t.Fatal(facts)
+	}
+	expect_reply(t, ss.reader, 250)
+}
+
+func Test_Abor(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("ABOR", 226)
+	ss.send("RETR download.bin", 425)
+
+	/* the upload blocks on the data connection until ABOR */
+	var data = ss.pasv()
+	defer data.Close()
+	ss.send("STOR aborted.bin", 150)
+	_, err := data.Write([]byte("partial"))
+	check_err(err, t)
+
+	ss.send("NOOP", 200)
+
+	/* a command refused during the transfer doesn't hold back the next */
+	check_err(ss.ctl.SetReadDeadline(time.Now().Add(5*time.Second)), t)
+	_, err = ss.ctl.Write([]byte("CWD /\r\nNOOP\r\nSTAT\r\n"))
+	check_err(err, t)
+	expect_reply(t, ss.reader, 503)
+	expect_reply(t, ss.reader, 200)
+	for msg := expect_reply(t, ss.reader, 211); !strings.HasPrefix(msg, "211 "); {
+		msg = read_reply(t, ss.reader)
+	}
+
+	ss.send("ABOR", 426)
+	expect_reply(t, ss.reader, 226)
+
+	/* the session goes on */
+	ss.send("PWD", 257)
+}
+
+func Test_Stat(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var status = func(code int) string {
+		var msg = ss.send("STAT", code)
+		for {
+			var line = read_reply(t, ss.reader)
+			msg += line
+			if strings.HasPrefix(line, strconv.Itoa(code)+" ") {
+				return msg
+			}
+		}
+	}
+
+	var msg = status(211)
+	if !strings.Contains(msg, " Logged in as root\r\n") ||
+		!strings.Contains(msg, " Current directory /\r\n") ||
+		!strings.Contains(msg, " No data connection\r\n") {
+		t.Fatal(msg)
+	}
+
+	var data = ss.pasv()
+	defer data.Close()
+	ss.send("STOR stat.bin", 150)
+	_, err := data.Write([]byte("partial"))
+	check_err(err, t)
+
+	for i := 0; ; i++ {
+		msg = status(211)
+		if strings.Contains(msg, " Transfer in progress: STOR stat.bin, 7 bytes\r\n") {
+			break
+		}
+		if i > 50 {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(msg, " Data connection: passive, plain text\r\n") {
+		t.Fatal(msg)
+	}
+
+	/* a listing over the control connection */
+	ss.send("STAT /", 212)
+	var list = ""
+	for {
+		var line = read_reply(t, ss.reader)
+		if strings.HasPrefix(line, "212 ") {
+			break
+		}
+		list += line
+	}
+	if !strings.Contains(list, " download.bin\r\n") {
+		t.Fatal(list)
+	}
+
+	ss.send("STAT download.bin", 213)
+	read_reply(t, ss.reader)
+	expect_reply(t, ss.reader, 213)
+	ss.send("STAT nonexist.bin", 550)
+
+	ss.send("ABOR", 426)
+	expect_reply(t, ss.reader, 226)
+}
+
+func Test_TypeAscii(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("TYPE E", 504)
+	ss.send("TYPE A T", 504)
+	ss.send("TYPE X", 501)
+	ss.send("TYPE L 8", 200)
+	ss.send("TYPE A", 200)
+
+	var data = ss.pasv()
+	ss.send("STOR report.txt", 150)
+	_, err := data.Write([]byte("one\r\ntwo\r\nbare\rthree\r"))
+	check_err(err, t)
+	check_err(data.Close(), t)
+	expect_reply(t, ss.reader, 226)
+
+	content, err := ioutil.ReadFile(default_test_path + "/report.txt")
+	check_err(err, t)
+	if string(content) != "one\ntwo\nbare\rthree\r" {
+		t.Fatalf("%q", content)
+	}
+
+	check_err(ioutil.WriteFile(default_test_path+"/unix.txt",
+		[]byte("one\ntwo\r\nthree\n"), 0600), t)
+
+	data = ss.pasv()
+	ss.send("RETR unix.txt", 150)
+	content, err = ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if string(content) != "one\r\ntwo\r\nthree\r\n" {
+		t.Fatalf("%q", content)
+	}
+
+	/* binary is untouched */
+	ss.send("TYPE I", 200)
+	data = ss.pasv()
+	ss.send("RETR unix.txt", 150)
+	content, err = ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if string(content) != "one\ntwo\r\nthree\n" {
+		t.Fatalf("%q", content)
+	}
+}
+
+func Test_Stou(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("STOU", 425)
+
+	for _, expect := range []string{"upload.bin.1", "upload.bin.2"} {
+		var data = ss.pasv()
+		var msg = ss.send("STOU upload.bin", 150)
+		if strings.TrimSpace(msg) != "150 FILE: "+expect {
+			t.Fatal(msg)
+		}
+
+		_, err := data.Write([]byte(expect))
+		check_err(err, t)
+		check_err(data.Close(), t)
+
+		msg = expect_reply(t, ss.reader, 226)
+		if !strings.Contains(msg, "unique file name:"+expect+")") {
+			t.Fatal(msg)
+		}
+
+		content, err := ioutil.ReadFile(default_test_path + "/" + expect)
+		check_err(err, t)
+		if string(content) != expect {
+			t.Fatal(string(content))
+		}
+	}
+
+	var data = ss.pasv()
+	ss.send("STOU", 150)
+	check_err(data.Close(), t)
+	expect_reply(t, ss.reader, 226)
+	if _, err := os.Stat(default_test_path + "/ftp.file"); err != nil {
+		t.Fatal(err)
+	}
+
+	/* the name is reported the way it was created */
+	ss.send("MKD sub", 257)
+	data = ss.pasv()
+	if msg := ss.send("STOU ./sub/", 150); strings.TrimSpace(msg) != "150 FILE: sub.1" {
+		t.Fatal(msg)
+	}
+	check_err(data.Close(), t)
+	expect_reply(t, ss.reader, 226)
+	data = ss.pasv()
+	if msg := ss.send("STOU sub/./a.bin", 150); strings.TrimSpace(msg) != "150 FILE: sub/a.bin" {
+		t.Fatal(msg)
+	}
+	check_err(data.Close(), t)
+	expect_reply(t, ss.reader, 226)
+
+	/* nothing is left behind when the data connection fails */
+	listen, err := net.Listen("tcp4", "127.0.0.1:0")
+	check_err(err, t)
+	var port = listen.Addr().(*net.TCPAddr).Port
+	check_err(listen.Close(), t)
+	ss.send("PORT 127,0,0,1,"+strconv.Itoa(port>>8)+","+strconv.Itoa(port&0xff), 200)
+	ss.send("STOU keep.bin", 150)
+	expect_reply(t, ss.reader, 425)
+	if _, err := os.Stat(default_test_path + "/keep.bin"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
+
 func init() {
 	go Start()
 	time.Sleep(1 * time.Second)
 }
+
+func Test_Mfmt(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var msg = ss.send("MFMT 20020717210715 download.bin", 213)
+	if strings.TrimSpace(msg) != "213 Modify=20020717210715; download.bin" {
+		t.Fatal(msg)
+	}
+	msg = ss.send("MDTM download.bin", 213)
+	if strings.TrimSpace(msg) != "213 20020717210715" {
+		t.Fatal(msg)
+	}
+
+	msg = ss.send("MFF modify=20100101000000.5; download.bin", 213)
+	if strings.TrimSpace(msg) != "213 modify=20100101000000.5; download.bin" {
+		t.Fatal(msg)
+	}
+	stat, err := os.Stat(default_download_path)
+	check_err(err, t)
+	if !stat.ModTime().Equal(time.Date(2010, 1, 1, 0, 0, 0, 5e8, time.UTC)) {
+		t.Fatal(stat.ModTime())
+	}
+
+	/* old files show the year instead of the time */
+	var data = ss.pasv()
+	ss.send("LIST", 150)
+	list, err := ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if !strings.Contains(string(list), " Jan  1  2010 download.bin") {
+		t.Fatal(string(list))
+	}
+
+	ss.send("MFMT 2002 download.bin", 501)
+	ss.send("MFMT 20020717210715 nonexist.bin", 550)
+	ss.send("MFF unix.mode=0777; download.bin", 504)
+	ss.send("MFF modify=20020717210715 download.bin", 501)
+
+	var feat = ss.send("FEAT", 211)
+	for !strings.HasPrefix(feat, "211 ") {
+		feat = read_reply(t, ss.reader)
+		if strings.HasPrefix(feat, " MFF ") && !strings.Contains(feat, "modify;") {
+			t.Fatal(feat)
+		}
+	}
+
+	Conf.Users[0].SetTime = false
+	defer func() { Conf.Users[0].SetTime = true }()
+
+	var other = create_session(t, "root", "root")
+	defer other.ctl.Close()
+	other.send("MFMT 20020717210715 download.bin", 530)
+}
+
+func Test_Hash(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	content, err := ioutil.ReadFile(default_download_path)
+	check_err(err, t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var msg = ss.send("HASH download.bin", 213)
+	var expect = fmt.Sprintf("213 SHA-256 0-%d %x download.bin", len(content), sha256.Sum256(content))
+	if strings.TrimSpace(msg) != expect {
+		t.Fatal(msg)
+	}
+
+	ss.send("OPTS HASH SHA-3", 501)
+	msg = ss.send("OPTS HASH md5", 200)
+	if strings.TrimSpace(msg) != "200 MD5" {
+		t.Fatal(msg)
+	}
+	msg = ss.send("HASH download.bin", 213)
+	if !strings.Contains(msg, fmt.Sprintf(" %x ", md5.Sum(content))) {
+		t.Fatal(msg)
+	}
+
+	msg = ss.send("XMD5 \"download.bin\" 10 1000", 250)
+	if strings.TrimSpace(msg) != fmt.Sprintf("250 %x", md5.Sum(content[10:1000])) {
+		t.Fatal(msg)
+	}
+	msg = ss.send("XCRC download.bin 100", 250)
+	if strings.TrimSpace(msg) != fmt.Sprintf("250 %08x", crc32.ChecksumIEEE(content[100:])) {
+		t.Fatal(msg)
+	}
+	msg = ss.send("XSHA256 download.bin", 250)
+	if strings.TrimSpace(msg) != fmt.Sprintf("250 %x", sha256.Sum256(content)) {
+		t.Fatal(msg)
+	}
+
+	ss.send("XSHA1 download.bin 10 5", 501)
+	ss.send("XSHA1 download.bin 99999999", 554)
+	ss.send("XSHA1 nonexist.bin", 550)
+	ss.send("HASH nonexist.bin", 550)
+
+	var feat = ss.send("FEAT", 211)
+	var found = false
+	for !strings.HasPrefix(feat, "211 ") {
+		feat = read_reply(t, ss.reader)
+		if strings.HasPrefix(feat, " HASH ") {
+			found = strings.Contains(feat, "MD5*;SHA-1;")
+		}
+	}
+	if !found {
+		t.Fatal("HASH isn't in FEAT")
+	}
+}
+
+func Test_ModeZ(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	content, err := ioutil.ReadFile(default_download_path)
+	check_err(err, t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("MODE B", 504)
+	ss.send("MODE C", 504)
+	ss.send("MODE X", 501)
+	ss.send("OPTS MODE Z LEVEL 10", 501)
+	ss.send("OPTS MODE Z LEVEL 9", 200)
+	ss.send("MODE Z", 200)
+
+	var data = ss.pasv()
+	ss.send("RETR download.bin", 150)
+	reader, err := zlib.NewReader(data)
+	check_err(err, t)
+	download, err := ioutil.ReadAll(reader)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if !bytes.Equal(download, content) {
+		t.Fatal("MODE Z download differs")
+	}
+
+	var upload = []byte(strings.Repeat("id,name,value\n", 1000))
+	data = ss.pasv()
+	ss.send("STOR modez.csv", 150)
+	var writer = zlib.NewWriter(data)
+	_, err = writer.Write(upload)
+	check_err(err, t)
+	check_err(writer.Close(), t)
+	check_err(data.Close(), t)
+	expect_reply(t, ss.reader, 226)
+	stored, err := ioutil.ReadFile(default_test_path + "/modez.csv")
+	check_err(err, t)
+	if !bytes.Equal(stored, upload) {
+		t.Fatal("MODE Z upload differs")
+	}
+
+	data = ss.pasv()
+	ss.send("LIST", 150)
+	reader, err = zlib.NewReader(data)
+	check_err(err, t)
+	list, err := ioutil.ReadAll(reader)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if !strings.Contains(string(list), "modez.csv") {
+		t.Fatal(string(list))
+	}
+
+	ss.send("MODE S", 200)
+	data = ss.pasv()
+	ss.send("LIST", 150)
+	list, err = ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if !strings.Contains(string(list), "modez.csv") {
+		t.Fatal(string(list))
+	}
+
+	/* the MODE of the transfer start applies, not the one of PASV */
+	data = ss.pasv()
+	ss.send("MODE Z", 200)
+	ss.send("RETR download.bin", 150)
+	reader, err = zlib.NewReader(data)
+	check_err(err, t)
+	download, err = ioutil.ReadAll(reader)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if !bytes.Equal(download, content) {
+		t.Fatal("MODE Z after PASV differs")
+	}
+
+	data = ss.pasv()
+	ss.send("MODE S", 200)
+	ss.send("RETR download.bin", 150)
+	download, err = ioutil.ReadAll(data)
+	check_err(err, t)
+	expect_reply(t, ss.reader, 226)
+	if !bytes.Equal(download, content) {
+		t.Fatal("MODE S after PASV differs")
+	}
+}
+
+/* registrations are global, a repeated run must not register twice */
+var site_echo sync.Once
+
+func Test_Site(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	site_echo.Do(func() {
+		RegisterSite("echo", func(command string, info []byte, ftp *Ftp) error {
+			return ftp.Reply(CodeOK, command+" "+string(info))
+		})
+	})
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var msg = ss.send("SITE echo hello world", 200)
+	if strings.TrimSpace(msg) != "200 SITE ECHO hello world" {
+		t.Fatal(msg)
+	}
+	ss.send("SITE", 501)
+	ss.send("SITE NONEXIST", 504)
+
+	var help = ss.send("SITE HELP", 214)
+	var names []string
+	for !strings.HasPrefix(help, "214 ") {
+		help = read_reply(t, ss.reader)
+		names = append(names, strings.TrimSpace(help))
+	}
+	if strings.Join(names[:6], ",") != "CHMOD,ECHO,HELP,IDLE,RMDIR,UMASK" {
+		t.Fatal(names)
+	}
+
+	ss.send("SITE CHMOD 640 download.bin", 200)
+	stat, err := os.Stat(default_download_path)
+	check_err(err, t)
+	if stat.Mode().Perm() != 0640 {
+		t.Fatal(stat.Mode())
+	}
+	ss.send("SITE CHMOD 4755 download.bin", 501)
+	ss.send("SITE CHMOD 755", 501)
+	ss.send("SITE CHMOD 755 nonexist.bin", 550)
+
+	/* neither a link nor a linked directory leads chmod out of the root */
+	outside, err := ioutil.TempDir("", "outside_root")
+	check_err(err, t)
+	defer os.RemoveAll(outside)
+	check_err(ioutil.WriteFile(outside+"/secret", nil, 0600), t)
+	check_err(os.Symlink(outside+"/secret", default_test_path+"/secret"), t)
+	check_err(os.Symlink(outside, default_test_path+"/shared"), t)
+	ss.send("SITE CHMOD 777 secret", 550)
+	ss.send("SITE CHMOD 777 shared/secret", 550)
+	stat, err = os.Stat(outside + "/secret")
+	check_err(err, t)
+	if stat.Mode().Perm() != 0600 {
+		t.Fatal(stat.Mode())
+	}
+
+	msg = ss.send("SITE UMASK", 200)
+	if strings.TrimSpace(msg) != "200 Current UMASK is 022" {
+		t.Fatal(msg)
+	}
+	ss.send("SITE UMASK 999", 501)
+	ss.send("SITE UMASK 077", 200)
+	ss.send("MKD private", 257)
+	stat, err = os.Stat(default_test_path + "/private")
+	check_err(err, t)
+	if stat.Mode().Perm() != 0700 {
+		t.Fatal(stat.Mode())
+	}
+
+	ss.send("SITE IDLE 0", 501)
+	ss.send("SITE IDLE 1", 200)
+	time.Sleep(1500 * time.Millisecond)
+	expect_reply(t, ss.reader, 421)
+
+	Conf.Users[0].Chmod = false
+	defer func() { Conf.Users[0].Chmod = true }()
+
+	var other = create_session(t, "root", "root")
+	defer other.ctl.Close()
+	other.send("SITE CHMOD 755 download.bin", 530)
+	other.send("SITE UMASK", 530)
+	other.send("SITE IDLE", 200)
+
+	Conf.Users[0].SetIdle = false
+	defer func() { Conf.Users[0].SetIdle = true }()
+
+	var idle = create_session(t, "root", "root")
+	defer idle.ctl.Close()
+	idle.send("SITE IDLE", 530)
+	idle.send("SITE IDLE 7200", 530)
+}
+
+func Test_Host(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var dial = func() *session {
+		ctl, err := net.Dial("tcp4", Conf.Ftp_addr+":"+Conf.Ftp_port)
+		check_err(err, t)
+		var ss = &session{t: t, ctl: ctl, reader: bufio.NewReader(ctl)}
+		var msg = expect_reply(t, ss.reader, 220)
+		if strings.TrimSpace(msg) != "220 "+Conf.Ftp_banner {
+			t.Fatal(msg)
+		}
+		return ss
+	}
+
+	var ss = dial()
+	defer ss.ctl.Close()
+	ss.send("HOST", 501)
+	ss.send("HOST ftp.nonexist.com", 504)
+	var msg = ss.send("HOST FTP.Example.com", 220)
+	if strings.TrimSpace(msg) != "220 Example FTP Server Ready" {
+		t.Fatal(msg)
+	}
+
+	/* only the users of the selected host can log in */
+	ss.send("USER root", 331)
+	ss.send("PASS root", 530)
+
+	var other = dial()
+	defer other.ctl.Close()
+	other.send("HOST ftp.example.com", 220)
+	other.send("USER example", 331)
+	other.send("PASS example", 230)
+	other.send("HOST ftp.example.com", 503)
+
+	/* the host's umask of 077 applies to uploads */
+	var data = other.pasv()
+	other.send("STOR host.bin", 150)
+	check_err(data.Close(), t)
+	expect_reply(t, other.reader, 226)
+	stat, err := os.Stat(default_test_path + "/host.bin")
+	check_err(err, t)
+	if stat.Mode().Perm() != 0600 {
+		t.Fatal(stat.Mode())
+	}
+
+	/* without HOST the server's own users apply */
+	var plain = dial()
+	defer plain.ctl.Close()
+	plain.send("USER example", 331)
+	plain.send("PASS example", 530)
+	plain.send("USER root", 331)
+	plain.send("PASS root", 230)
+}
+
+func Test_SessionState(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	ctl, err := net.Dial("tcp4", Conf.Ftp_addr+":"+Conf.Ftp_port)
+	check_err(err, t)
+	defer ctl.Close()
+
+	var ss = &session{t: t, ctl: ctl, reader: bufio.NewReader(ctl)}
+	expect_reply(t, ss.reader, 220)
+
+	/* connected */
+	ss.send("FEAT", 211)
+	for msg := ""; !strings.HasPrefix(msg, "211 "); {
+		msg = read_reply(t, ss.reader)
+	}
+	ss.send("NOOP", 200)
+	ss.send("PASS root", 503)
+	ss.send("LIST", 530)
+	ss.send("CWD /", 530)
+	ss.send("PWD", 530)
+	ss.send("PASV", 530)
+	ss.send("PORT 127,0,0,1,4,1", 530)
+	ss.send("RNTO renamed.bin", 530)
+
+	/* a wrong password drops the user and its permissions */
+	ss.send("USER root", 331)
+	ss.send("PWD", 530)
+	ss.send("PASS wrong", 530)
+	ss.send("PASS root", 503)
+	ss.send("DELE download.bin", 530)
+	if _, err := os.Stat(default_download_path); err != nil {
+		t.Fatal(err)
+	}
+
+	ss.send("USER root", 331)
+	ss.send("PASS root", 230)
+	ss.send("USER root", 503)
+	ss.send("HOST ftp.example.com", 503)
+	ss.send("PWD", 257)
+	ss.send("RNTO renamed.bin", 503)
+
+	/* transferring: a stalled RETR doesn't hold back the refusal or ABOR */
+	check_err(os.Truncate(default_download_path, 256*1024*1024), t)
+	var data = ss.pasv()
+	defer data.Close()
+	ss.send("RETR download.bin", 150)
+
+	check_err(ctl.SetReadDeadline(time.Now().Add(5*time.Second)), t)
+	_, err = ctl.Write([]byte("PWD\r\nABOR\r\n"))
+	check_err(err, t)
+	expect_reply(t, ss.reader, 503)
+	expect_reply(t, ss.reader, 426)
+	expect_reply(t, ss.reader, 226)
+	ss.send("PWD", 257)
+}
+
+func Test_CommandLine(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("pwd", 257)
+	ss.send("Size download.bin", 213)
+
+	ss.send("MKD my dir", 257)
+	ss.send("cwd my dir", 250)
+	ss.send("cdup", 200)
+
+	ss.send("NOOP "+strings.Repeat("x", Conf.Ftp_max_line), 500)
+	ss.send("NOOP", 200)
+
+	/* ABOR as clients send it, behind Telnet IP and DM */
+	ss.send("\xff\xf4\xff\xf2ABOR", 226)
+}
+
+func Test_Lang(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	var featLang = func() string {
+		var feat = ss.send("FEAT", 211)
+		var lang string
+		for !strings.HasPrefix(feat, "211 ") {
+			feat = read_reply(t, ss.reader)
+			if strings.HasPrefix(feat, " LANG ") {
+				lang = strings.TrimSpace(feat)
+			}
+		}
+		return lang
+	}
+
+	if lang := featLang(); lang != "LANG EN*;zh-CN" {
+		t.Fatal(lang)
+	}
+
+	ss.send("LANG fr", 504)
+	ss.send("LANG zh_CN", 501)
+
+	/* a primary tag finds the language, replies follow it */
+	var msg = ss.send("LANG zh", 200)
+	if strings.TrimSpace(msg) != "200 语言已设置为 zh-CN" {
+		t.Fatal(msg)
+	}
+	if msg = ss.send("NOOP", 200); strings.TrimSpace(msg) != "200 NOOP 成功" {
+		t.Fatal(msg)
+	}
+	if lang := featLang(); lang != "LANG EN;zh-CN*" {
+		t.Fatal(lang)
+	}
+
+	/* texts without a translation fall back to English */
+	if msg = ss.send("TYPE X", 501); !strings.Contains(msg, "Unknown type") {
+		t.Fatal(msg)
+	}
+	if msg = ss.send("STAT download.bin", 213); msg != "213-download.bin 的状态:\r\n" {
+		t.Fatal(msg)
+	}
+	for !strings.HasPrefix(msg, "213 ") {
+		msg = read_reply(t, ss.reader)
+	}
+
+	ss.send("LANG", 200)
+	if msg = ss.send("NOOP", 200); strings.TrimSpace(msg) != "200 NOOP ok" {
+		t.Fatal(msg)
+	}
+}
+
+func Test_DelTree(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	ss.send("MKD tree", 257)
+	ss.send("MKD tree/sub", 257)
+	check_err(ioutil.WriteFile(default_test_path+"/tree/sub/a.txt", []byte("a"), 0644), t)
+	check_err(ioutil.WriteFile(default_test_path+"/tree/b.txt", []byte("b"), 0644), t)
+
+	/* RMD doesn't remove what is in a dictionary */
+	ss.send("RMD tree", 550)
+	ss.send("SITE RMDIR tree", 550)
+
+	/* the permissions are taken at login */
+	Conf.Users[0].DelTree = false
+	var other = create_session(t, "root", "root")
+	other.send("RMDA tree", 530)
+	other.ctl.Close()
+	Conf.Users[0].DelTree = true
+
+	ss.send("RMDA .", 550)
+	ss.send("RMDA ..", 550)
+
+	var msg = ss.send("SITE RMDIR -r tree/sub", 250)
+	if !strings.Contains(msg, " 2 entries removed") {
+		t.Fatal(msg)
+	}
+	if msg = ss.send("RMDA tree", 250); !strings.Contains(msg, " 2 entries removed") {
+		t.Fatal(msg)
+	}
+	if _, err := os.Stat(default_test_path + "/tree"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	ss.send("MKD empty", 257)
+	ss.send("SITE RMDIR empty", 250)
+	ss.send("MKD empty", 257)
+	ss.send("RMD empty", 250)
+	ss.send("RMD empty", 550)
+
+	/* links are unlinked, what they point to outside the root stays */
+	outside, err := ioutil.TempDir("", "outside_root")
+	check_err(err, t)
+	defer os.RemoveAll(outside)
+	check_err(os.Mkdir(outside+"/sub", 0755), t)
+	check_err(ioutil.WriteFile(outside+"/sub/keep.txt", []byte("keep"), 0644), t)
+	check_err(os.Symlink(outside, default_test_path+"/shared"), t)
+
+	ss.send("RMDA shared/sub", 550)
+	if msg := ss.send("SITE RMDIR -r shared", 250); !strings.Contains(msg, " 1 entries removed") {
+		t.Fatal(msg)
+	}
+
+	ss.send("MKD tree", 257)
+	check_err(os.Symlink(outside, default_test_path+"/tree/link"), t)
+	if msg := ss.send("RMDA tree", 250); !strings.Contains(msg, " 2 entries removed") {
+		t.Fatal(msg)
+	}
+	if _, err := os.Stat(outside + "/sub/keep.txt"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_SessionExit(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	var addr = ss.pasvAddr()
+	ss.send("RETR download.bin", 150)
+
+	/* the waiting transfer ends with the session, its listener too */
+	check_err(ss.ctl.Close(), t)
+	time.Sleep(500 * time.Millisecond)
+	if data, err := net.Dial("tcp4", addr); err == nil {
+		data.Close()
+		t.Fatal("the PASV listener is still open")
+	}
+
+	/* a running transfer stops before all of the file is sent, the
+	file is larger than what the socket buffers take */
+	const size = 256 * 1024 * 1024
+	check_err(os.Truncate(default_download_path, size), t)
+	ss = create_session(t, "root", "root")
+	var data = ss.pasv()
+	defer data.Close()
+	ss.send("RETR download.bin", 150)
+	check_err(ss.ctl.Close(), t)
+
+	time.Sleep(500 * time.Millisecond)
+	n, _ := io.Copy(ioutil.Discard, data)
+	if n >= size {
+		t.Fatal("the whole file was sent", n)
+	}
+}
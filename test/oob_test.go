@@ -0,0 +1,34 @@
+//go:build !windows
+
+package test
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+/* RFC 959 ABOR: "IAC IP", then "IAC DM" with DM as TCP urgent data */
+func Test_AborUrgent(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	_, err := ss.ctl.Write([]byte("\xff\xf4\xff"))
+	check_err(err, t)
+
+	raw, err := ss.ctl.(*net.TCPConn).SyscallConn()
+	check_err(err, t)
+	var sendErr error
+	check_err(raw.Write(func(fd uintptr) bool {
+		sendErr = syscall.Sendto(int(fd), []byte{0xf2}, syscall.MSG_OOB, nil)
+		return true
+	}), t)
+	check_err(sendErr, t)
+
+	/* without SO_OOBINLINE the server never sees the DM */
+	ss.send("ABOR", 226)
+	ss.send("NOOP", 200)
+}
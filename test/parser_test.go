@@ -0,0 +1,103 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	. "ftpserver"
+)
+
+func Test_ParseCommand(t *testing.T) {
+	var cases = []struct {
+		line    string
+		command string
+		info    string
+	}{
+		{"RETR my report.pdf", "RETR", "my report.pdf"},
+		{"retr download.bin", "RETR", "download.bin"},
+		{"NOOP", "NOOP", ""},
+		{"CWD ", "CWD", ""},
+		{"\xff\xf4\xff\xf2ABOR", "ABOR", ""},
+		{"\xff\xf4\xffABOR", "ABOR", ""},
+		{"\xff\xfb\x01STOR a\xff\xffb", "STOR", "a\xffb"},
+		{"\xff\xfa\x18\x00xterm\xff\xf0PWD", "PWD", ""},
+	}
+
+	for _, c := range cases {
+		command, info := ParseCommand([]byte(c.line))
+		if command != c.command || string(info) != c.info {
+			t.Fatalf("%q: %q %q", c.line, command, info)
+		}
+	}
+}
+
+func Test_ReadCommand(t *testing.T) {
+	var input = "USER root\r\n" + strings.Repeat("x", 5000) + "\r\nPASS root\nNOOP"
+	var reader = bufio.NewReaderSize(strings.NewReader(input), 16)
+
+	for _, expect := range []string{"USER root", "", "PASS root", "NOOP"} {
+		line, err := ReadCommand(reader, 100)
+		if expect == "" {
+			if err != ErrLineTooLong {
+				t.Fatal(err)
+			}
+			continue
+		}
+		check_err(err, t)
+		if string(line) != expect {
+			t.Fatalf("%q", line)
+		}
+	}
+
+	if _, err := ReadCommand(reader, 100); err == nil {
+		t.Fatal("expect EOF")
+	}
+}
+
+func FuzzParseCommand(f *testing.F) {
+	f.Add([]byte("RETR my report.pdf"))
+	f.Add([]byte("\xff\xf4\xff\xf2ABOR"))
+	f.Add([]byte("\xff\xfa\x18\xff"))
+	f.Add([]byte("site chmod 755 a b"))
+
+	f.Fuzz(func(t *testing.T, line []byte) {
+		command, info := ParseCommand(line)
+		if strings.Contains(command, " ") || command != strings.ToUpper(command) {
+			t.Fatalf("%q: command %q", line, command)
+		}
+
+		/* without Telnet commands nothing is lost but the space */
+		if bytes.IndexByte(line, 0xff) < 0 && len(info) > 0 &&
+			!strings.EqualFold(command+" "+string(info), string(line)) {
+			t.Fatalf("%q: %q %q", line, command, info)
+		}
+	})
+}
+
+func FuzzReadCommand(f *testing.F) {
+	f.Add([]byte("USER root\r\nPASS root\r\n"), 8)
+	f.Add([]byte("\n\n\r\n"), 1)
+	f.Add([]byte(strings.Repeat("a", 100)+"\nNOOP"), 16)
+
+	f.Fuzz(func(t *testing.T, input []byte, max int) {
+		if max < 1 || max > 1<<16 {
+			return
+		}
+
+		var reader = bufio.NewReaderSize(bytes.NewReader(input), 16)
+		for lines := 0; lines <= len(input); lines++ {
+			line, err := ReadCommand(reader, max)
+			if err == ErrLineTooLong {
+				continue
+			} else if err != nil {
+				return
+			}
+			if len(line) > max || bytes.HasSuffix(line, []byte("\n")) {
+				t.Fatalf("%q: %q", input, line)
+			}
+		}
+		t.Fatalf("%q: ReadCommand doesn't reach the end", input)
+	})
+}
@@ -0,0 +1,73 @@
+package test
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"testing"
+
+	. "ftpserver"
+)
+
+func Test_MultiReply(t *testing.T) {
+	var reply = NewMultiReply(CodeSystemStatus, "Features:")
+	reply.Line("MDTM").Linef("REST %s", "STREAM").Line("226 looks like a reply\r\n")
+
+	var expect = "211-Features:\r\n MDTM\r\n REST STREAM\r\n 226 looks like a reply\r\n211 End\r\n"
+	if msg := reply.Format("End"); msg != expect {
+		t.Fatalf("%q", msg)
+	}
+
+	/* a multi-line first or last text keeps the reply well-formed */
+	reply = NewMultiReply(CodeHelpMessage, "first\nsecond")
+	expect = "214-first\r\n second\r\n third\r\n214 fourth\r\n"
+	if msg := reply.Format("third\r\nfourth"); msg != expect {
+		t.Fatalf("%q", msg)
+	}
+
+	/* the arguments of the first line are data, not a format */
+	reply = NewMultiReply(CodeFileStatus, "Status of %s:", "100%d.bin")
+	expect = "213-Status of 100%d.bin:\r\n213 End\r\n"
+	if msg := reply.Format("End"); msg != expect {
+		t.Fatalf("%q", msg)
+	}
+}
+
+func Test_ReplyFormat(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	var ss = create_session(t, "root", "root")
+	defer ss.ctl.Close()
+
+	/* exactly one line each, no stray space or empty line */
+	var raw = func(command string, pattern string) {
+		_, err := ss.ctl.Write([]byte(command + "\r\n"))
+		check_err(err, t)
+		line, err := ss.reader.ReadString('\n')
+		check_err(err, t)
+		if !regexp.MustCompile(pattern).MatchString(line) {
+			t.Fatalf("%s: %q", command, line)
+		}
+	}
+
+	raw("PASV", `^227 Entering Passive Mode \(\d+,\d+,\d+,\d+,\d+,\d+\)\r\n$`)
+	raw("CWD nonexist", `^501 [^\r\n]+\r\n$`)
+	raw("NOOP", `^200 NOOP ok\r\n$`)
+	raw("PWD", `^257 "/" is the current dictionary\r\n$`)
+	raw("MKD a\"b", `^257 "/a""b" created\r\n$`)
+	raw("CWD a\"b", `^250 [^\r\n]+\r\n$`)
+	raw("PWD", `^257 "/a""b" is the current dictionary\r\n$`)
+	raw("CDUP", `^200 [^\r\n]+\r\n$`)
+
+	listen, err := net.Listen("tcp4", "127.0.0.1:0")
+	check_err(err, t)
+	defer listen.Close()
+	var port = listen.Addr().(*net.TCPAddr).Port
+	raw("PORT 127,0,0,1,"+strconv.Itoa(port>>8)+","+strconv.Itoa(port&0xff), `^200 [^\r\n]+\r\n$`)
+
+	conn, err := listen.Accept()
+	check_err(err, t)
+	defer conn.Close()
+	raw("STOR", `^501 [^\r\n]+\r\n$`)
+}
@@ -0,0 +1,107 @@
+package test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	. "ftpserver"
+)
+
+func create_tls_config(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check_err(err, t)
+
+	var template = x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	check_err(err, t)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func Test_AuthTLS(t *testing.T) {
+	create_test_environment(t)
+	defer clean_test_environment(t)
+
+	Conf.Ftp_tls = create_tls_config(t)
+	defer func() { Conf.Ftp_tls = nil }()
+
+	var ctl, err = net.Dial("tcp4", Conf.Ftp_addr+":"+Conf.Ftp_port)
+	check_err(err, t)
+	defer ctl.Close()
+
+	var reader = bufio.NewReader(ctl)
+	expect_reply(t, reader, 220)
+
+	_, err = ctl.Write([]byte("AUTH TLS\r\n"))
+	check_err(err, t)
+	expect_reply(t, reader, 234)
+
+	var client = &tls.Config{InsecureSkipVerify: true}
+	var secure = tls.Client(ctl, client)
+	check_err(secure.Handshake(), t)
+	reader = bufio.NewReader(secure)
+
+	var send = func(command string, status int) string {
+		_, err := secure.Write([]byte(command + "\r\n"))
+		check_err(err, t)
+		return expect_reply(t, reader, status)
+	}
+
+	send("USER root", 331)
+	send("PASS root", 230)
+	send("PROT P", 503)
+	send("PBSZ 0", 200)
+	send("PROT P", 200)
+
+	var pasv = func() net.Conn {
+		var pasv = send("PASV", 227)
+		var ss = strings.Split(pasv[strings.Index(pasv, "(")+1:strings.Index(pasv, ")")], ",")
+		var port1, _ = strconv.Atoi(ss[4])
+		var port2, _ = strconv.Atoi(ss[5])
+
+		conn, err := net.Dial("tcp4", "127.0.0.1:"+strconv.Itoa(port1*256+port2))
+		check_err(err, t)
+		return conn
+	}
+
+	var list = func(conn net.Conn) {
+		send("LIST", 150)
+		list, err := ioutil.ReadAll(conn)
+		check_err(err, t)
+		if !strings.Contains(string(list), "download.bin") {
+			t.Fatal(string(list))
+		}
+		expect_reply(t, reader, 226)
+	}
+
+	list(tls.Client(pasv(), client))
+
+	/* the PROT level of the transfer start applies, not the one of PASV */
+	var conn = pasv()
+	send("PROT C", 200)
+	list(conn)
+
+	conn = pasv()
+	send("PROT P", 200)
+	list(tls.Client(conn, client))
+}
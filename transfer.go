@@ -0,0 +1,204 @@
+package ftpserver
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+type TransferDriver interface {
+	/* Run the data transfer of a command in its own goroutine, so
+	the control connection can still see ABOR, STAT and NOOP. */
+	StartTransfer(string, func(context.Context) error)
+	CancelTransfer() bool
+	WaitTransfer()
+	InTransfer() bool
+	GetTransferName() string
+}
+
+type TransferRequire interface {
+	ReplyRequire
+	HasDataConn() bool
+	WaitDataConn(context.Context) error
+	StartDataConn()
+	DataClose()
+	DataAbort()
+	StartTransfer(string, func(context.Context) error)
+}
+
+type Transfer struct {
+	mutex sync.Mutex
+	/* the session context, every transfer context derives from it */
+	session context.Context
+	exit    context.CancelFunc
+	cancel  context.CancelFunc
+	done    chan struct{}
+	/* the command of the running transfer, for STAT */
+	name string
+}
+
+func NewTransfer() *Transfer {
+	var transfer = new(Transfer)
+	transfer.session, transfer.exit = context.WithCancel(context.Background())
+	return transfer
+}
+
+func (transfer *Transfer) StartTransfer(name string, fn func(context.Context) error) {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	var ctx, cancel = context.WithCancel(transfer.session)
+	var done = make(chan struct{})
+	transfer.cancel = cancel
+	transfer.done = done
+	transfer.name = name
+
+	go func() {
+		if err := fn(ctx); err != nil {
+			Warnln(err)
+		}
+
+		transfer.mutex.Lock()
+		cancel()
+		transfer.cancel = nil
+		transfer.done = nil
+		transfer.name = ""
+		transfer.mutex.Unlock()
+		close(done)
+	}()
+}
+
+/* cancel the running transfer, false if there is none */
+func (transfer *Transfer) CancelTransfer() bool {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+
+	if transfer.cancel == nil {
+		return false
+	}
+	transfer.cancel()
+	return true
+}
+
+func (transfer *Transfer) WaitTransfer() {
+	transfer.mutex.Lock()
+	var done = transfer.done
+	transfer.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func (transfer *Transfer) InTransfer() bool {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+	return transfer.done != nil
+}
+
+func (transfer *Transfer) GetTransferName() string {
+	transfer.mutex.Lock()
+	defer transfer.mutex.Unlock()
+	return transfer.name
+}
+
+/* the session is over, stop whatever is still running */
+func (transfer *Transfer) ExitTransfer() {
+	transfer.exit()
+}
+
+/* stops a running copy as soon as the transfer is aborted */
+type contextWriter struct {
+	ctx    context.Context
+	writer io.Writer
+}
+
+func (w contextWriter) Write(msg []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.writer.Write(msg)
+}
+
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r contextReader) Read(msg []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(msg)
+}
+
+// runTransfer sends the 150 preliminary reply start, translated by the
+// caller, and moves the transfer
+// fn into its own goroutine. The closing reply is 226 on success, 426 if
+// ABOR interrupted the transfer and 451 if fn failed.
+func runTransfer(require TransferRequire, name string, start string,
+	fn func(context.Context) error) error {
+	return runTransferReply(require, name, start, require.Translate(
+		"Close the data connection, the requested file operation is successful"), fn, nil)
+}
+
+// runTransferReply is runTransfer with its own 226 reply text. undo, if
+// not nil, runs instead of fn when the data connection never opens.
+func runTransferReply(require TransferRequire, name string, start string,
+	done string, fn func(context.Context) error, undo func()) error {
+
+	if !require.HasDataConn() {
+		return require.Reply(CodeCantOpenDataConn, "Use PORT or PASV first")
+	}
+
+	if err := require.reply(CodeFileStatusOK, start); err != nil {
+		return err
+	}
+
+	require.StartTransfer(name, func(ctx context.Context) error {
+		var err = require.WaitDataConn(ctx)
+		if err != nil && undo != nil {
+			undo()
+		}
+		if err == nil {
+			require.StartDataConn()
+			err = fn(ctx)
+		} else if ctx.Err() == nil {
+			require.DataClose()
+			return require.Reply(CodeCantOpenDataConn, "Can't open data connection")
+		}
+		require.DataClose()
+
+		if ctx.Err() != nil {
+			return require.Reply(CodeTransferAborted, "Connection closed; transfer aborted")
+		} else if err != nil {
+			return require.Replyf(CodeLocalError, "Abort the operation.%s", err.Error())
+		}
+		return require.reply(CodeClosingDataConn, done)
+	})
+	return nil
+}
+
+/* RFC 959: an aborted transfer is answered with 426, ABOR itself with 226 */
+func commandAbor(driver TransferDriver, require TransferRequire) error {
+	if !driver.CancelTransfer() {
+		require.DataClose()
+		return require.Reply(CodeClosingDataConn, "No transfer to abort")
+	}
+
+	require.DataAbort()
+	driver.WaitTransfer()
+	return require.Reply(CodeClosingDataConn, "Abort successful")
+}
+
+func TransferProc(command string, info []byte, ftp *Ftp) error {
+	if command == "ABOR" {
+		return commandAbor(ftp, ftp)
+	}
+	Fataln(command)
+	return nil
+}
+
+func init() {
+	register("ABOR", stateAuthenticated|stateTransferring, TransferProc)
+}
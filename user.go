@@ -1,24 +1,43 @@
 package ftpserver
 
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"time"
+)
+
 type UserDriver interface {
-	/* Check the user name and passwd is valid.
-	If the user name and passwd is valid,and
-	need to save the user name and passwd */
-	CheckUser(string) bool
-	CheckPass(string) bool
+	/* USER saves the name, PASS asks the Authenticator and saves
+	the identity it returns */
+	SetUserName(string)
+	Authenticate(pass string, remote net.Addr, state *tls.ConnectionState) (*Identity, error)
 
 	GetUserName() string
-	GetUid() int
+	GetRoot() string
 	CheckAuth(uint) bool
+
+	/* connected, user-given or authenticated */
+	SetLoginState(sessionState)
+	GetLoginState() sessionState
+	ResetUser()
+
+	/* RFC 7151 HOST, USER only finds the users of the selected host */
+	SelectHost(string) bool
+	GetBanner() string
+	GetHostUmask() os.FileMode
+	GetHostIdle() time.Duration
 }
 
 type UserRequire interface {
-	Response(string) error
-	SetRootEntry(int) error
+	ReplyRequire
+	SetRootEntry(string) error
+	SetUmask(os.FileMode)
+	SetIdle(time.Duration)
+	RemoteAddr() net.Addr
+	TLSState() *tls.ConnectionState
 }
 
-const invalidUid = -1
-
 const (
 	GET = iota
 	PUT
@@ -26,64 +45,108 @@ const (
 	RECOVER
 	MKDIR
 	DELDIR
+	APPEND
+	RENAME
+	SETTIME
+	CHMOD
+	DELTREE
+	SETIDLE
 )
 
 type User struct {
 	name     string
-	pass     string
-	uid      int
+	root     string
 	authFlag uint
+	/* nil until HOST, then the virtual host of the session */
+	host  *hostConf
+	login sessionState
+	auth  Authenticator
 }
 
-func NewUser() *User {
+func NewUser(auth Authenticator) *User {
 	return &User{
-		uid: invalidUid,
+		login: stateConnected,
+		auth:  auth,
 	}
 }
 
-func (user *User) CheckUser(name string) bool {
-	var setFlag = func(permit bool, flag uint) {
-		if permit {
-			user.authFlag |= uint(1) << flag
-		}
-	}
+/* forget the user of the last USER, the selected host stays */
+func (user *User) ResetUser() {
+	user.name = ""
+	user.root = ""
+	user.authFlag = 0
+	user.login = stateConnected
+}
 
-	for index, value := range Conf.Users {
+func (user *User) SetLoginState(state sessionState) {
+	user.login = state
+}
 
-		if value.Name != name {
-			continue
-		}
+func (user *User) GetLoginState() sessionState {
+	return user.login
+}
 
-		user.name = name
-		user.uid = index
-		user.pass = value.Pass
+func (user *User) SetUserName(name string) {
+	user.name = name
+}
 
-		setFlag(value.Get, GET)
-		setFlag(value.Put, PUT)
-		setFlag(value.Delete, DELETE)
-		setFlag(value.Recover, RECOVER)
-		setFlag(value.MkDir, MKDIR)
-		setFlag(value.DelDir, DELDIR)
+func (user *User) Authenticate(pass string, remote net.Addr,
+	state *tls.ConnectionState) (*Identity, error) {
+	var info = &AuthInfo{
+		Name:   user.name,
+		Pass:   pass,
+		Remote: remote,
+		TLS:    state,
+	}
+	if user.host != nil {
+		info.Host = user.host.Name
+	}
 
-		return true
+	id, err := user.auth.Authenticate(info)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, ErrAuthFailed
 	}
-	return false
-}
 
-func (user *User) CheckPass(pass string) bool {
-	return user.pass == pass
+	user.name = id.Name
+	user.root = id.Root
+	user.authFlag = id.Perms
+	return id, nil
 }
 
 func (user *User) GetUserName() string {
 	return user.name
 }
 
-func (user *User) GetUid() int {
-	return user.uid
+func (user *User) GetRoot() string {
+	return user.root
+}
+
+func (user *User) SelectHost(name string) bool {
+	var host = findHost(name)
+	if host == nil {
+		return false
+	}
+	user.host = host
+	return true
+}
+
+func (user *User) GetBanner() string {
+	return user.host.Banner
+}
+
+func (user *User) GetHostUmask() os.FileMode {
+	return user.host.Umask_mode
+}
+
+func (user *User) GetHostIdle() time.Duration {
+	return time.Duration(user.host.Idle_timeout) * time.Second
 }
 
 func (user *User) CheckAuth(auth uint) bool {
-	if user.uid == invalidUid {
+	if user.login != stateAuthenticated {
 		return false
 	}
 	auth = uint(1) << auth
@@ -94,23 +157,51 @@ func (user *User) CheckAuth(auth uint) bool {
 }
 
 func commandUser(info []byte, user UserDriver, require UserRequire) error {
-	/* Whether the check is successful or not, all return to success. */
-	user.CheckUser(string(info))
-	if user.GetUid() != invalidUid {
-		if err := require.SetRootEntry(user.GetUid()); err != nil {
-			Fataln(err)
+	/* Whether the user exists or not, all return to success. */
+	user.ResetUser()
+	user.SetLoginState(stateUserGiven)
+	user.SetUserName(string(info))
+	return require.Reply(CodeUserNameOK, "Login OK, send your password")
+}
+
+func commandPass(info []byte, user UserDriver, require UserRequire) error {
+	id, err := user.Authenticate(string(info), require.RemoteAddr(), require.TLSState())
+	if err == nil {
+		err = require.SetRootEntry(id.Root)
+	}
+
+	if err != nil {
+		if err != ErrAuthFailed {
+			Warnln(user.GetUserName(), err)
 		}
+		/* a failed login keeps nothing of the user, USER starts over */
+		user.ResetUser()
+		return require.Reply(CodeNotLoggedIn, "Permission denied")
+	}
+
+	if id.Umask != nil {
+		require.SetUmask(*id.Umask)
 	}
-	return require.Response("331 Login OK, send your password\r\n")
+	if id.Idle > 0 {
+		require.SetIdle(id.Idle)
+	}
+	user.SetLoginState(stateAuthenticated)
+	return require.Reply(CodeUserLoggedIn, "Login OK")
 }
 
-func commandPass(info []byte, user UserDriver, require UserRequire) error {
+/* RFC 7151: HOST picks the virtual host, only before USER */
+func commandHost(info []byte, user UserDriver, require UserRequire) error {
+	if len(info) == 0 {
+		return require.Reply(CodeParameterError, "Parameter syntax error.Please input host name")
+	}
 
-	if user.GetUid() != invalidUid && user.CheckPass(string(info)) {
-		return require.Response("230 Login OK\r\n")
-	} else {
-		return require.Response("530 Permission denied\r\n")
+	if !user.SelectHost(string(info)) {
+		return require.Replyf(CodeParameterNotImplemented, "Unknown host %s", string(info))
 	}
+
+	require.SetUmask(user.GetHostUmask())
+	require.SetIdle(user.GetHostIdle())
+	return require.Reply(CodeServiceReady, user.GetBanner())
 }
 
 func AuthProc(command string, info []byte, ftp *Ftp) error {
@@ -118,12 +209,15 @@ func AuthProc(command string, info []byte, ftp *Ftp) error {
 		return commandUser(info, ftp, ftp)
 	} else if command == "PASS" {
 		return commandPass(info, ftp, ftp)
+	} else if command == "HOST" {
+		return commandHost(info, ftp, ftp)
 	}
 	Fataln(command)
 	return nil
 }
 
 func init() {
-	register("USER", AuthProc)
-	register("PASS", AuthProc)
+	register("USER", stateConnected|stateUserGiven, AuthProc)
+	register("PASS", stateUserGiven, AuthProc)
+	register("HOST", stateConnected, AuthProc)
 }